@@ -5,6 +5,8 @@ package corpus
 
 import (
 	"context"
+	"maps"
+	"slices"
 	"sync"
 
 	"github.com/google/syzkaller/pkg/cover"
@@ -121,6 +123,8 @@ func (corpus *Corpus) Save(inp NewInput) {
 			newItem.Updates = append(newItem.Updates, update)
 		}
 		corpus.progs[sig] = newItem
+		// Edge counts follow the item signal, which is what the program is removed with.
+		corpus.addEdges(signal.FromRaw(old.Signal.DiffFromRaw(inp.Signal.ToRaw()), 0))
 	} else {
 		corpus.progs[sig] = &Item{
 			Sig:     sig,
@@ -147,6 +151,70 @@ func (corpus *Corpus) Save(inp NewInput) {
 		}
 	}
 }
+
+// Remove evicts the program with the signature sig (see Item.Sig) from the corpus, e.g. to bound
+// the corpus size during long runs. Returns false if there is no such program.
+// The total signal is recalculated from the remaining items, since the removed program may have been
+// the only one that covered some of it. Coverage is not reduced.
+func (corpus *Corpus) Remove(sig string) bool {
+	corpus.mu.Lock()
+	defer corpus.mu.Unlock()
+	item := corpus.progs[sig]
+	if item == nil {
+		return false
+	}
+	delete(corpus.progs, sig)
+	corpus.removeProgram(item.Prog, item.Signal)
+	corpus.signal = nil
+	for _, item := range corpus.progs {
+		corpus.signal.Merge(item.Signal)
+	}
+	return true
+}
+
+// Merge adds the programs of other to the corpus, e.g. to combine corpora of several fuzzer instances.
+// Programs are deduplicated by their serialized form, the ones present in both corpora get the union
+// of their signal and coverage as if they were saved again. Costs and priorities set with SetPriority
+// are carried over for the added programs. The two corpora are never locked at the same time.
+func (corpus *Corpus) Merge(other *Corpus) {
+	if other == corpus {
+		return
+	}
+	items := make(map[*prog.Prog]*Item)
+	for _, item := range other.Items() {
+		items[item.Prog] = item
+	}
+	pl := other.ProgramsList
+	pl.mu.RLock()
+	progs, costs, overrides := slices.Clone(pl.progs), maps.Clone(pl.costs), maps.Clone(pl.overrides)
+	pl.mu.RUnlock()
+	for _, p := range progs {
+		item := items[p]
+		if item == nil {
+			continue // saved to other after the items were taken
+		}
+		exists := corpus.Item(item.Sig) != nil
+		corpus.Save(NewInput{
+			Prog:   item.Prog,
+			Call:   item.Call,
+			Signal: item.Signal,
+			// Save modifies the coverage slice, and items of other must not change.
+			Cover: slices.Clone(item.Cover),
+		})
+		if exists {
+			continue
+		}
+		if cost, ok := costs[p]; ok {
+			corpus.SetCost(p, cost)
+		}
+		if prio, ok := overrides[p]; ok {
+			corpus.SetPriority(p, prio)
+		}
+	}
+}
+
+// Signal returns the union of signals of all corpus items, i.e. the distinct signal the corpus represents.
+// Minimize doesn't reduce it, since the remaining programs cover all of it.
 func (corpus *Corpus) Signal() signal.Signal {
 	corpus.mu.RLock()
 	defer corpus.mu.RUnlock()
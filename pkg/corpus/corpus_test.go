@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"testing"
 
+	"github.com/google/syzkaller/pkg/hash"
 	"github.com/google/syzkaller/pkg/signal"
 	"github.com/google/syzkaller/prog"
 	"github.com/google/syzkaller/sys/targets"
@@ -77,6 +78,109 @@ func TestCorpusCoverage(t *testing.T) {
 	assert.Equal(t, corpus.StatCover.Val(), 3)
 }
 
+func TestCorpusSignal(t *testing.T) {
+	target := getTarget(t, targets.TestOS, targets.TestArch64)
+	corpus := NewCorpus(context.Background())
+	rs := rand.NewSource(0)
+	for i := 0; i < 10; i++ {
+		inp := generateInput(target, rs, 5, 0)
+		// Overlapping signal with different priorities.
+		inp.Signal = signal.FromRaw([]uint64{uint64(i), uint64(i + 1), uint64(100 + i)}, uint8(i%3))
+		corpus.Save(inp)
+	}
+	union := func() signal.Signal {
+		var res signal.Signal
+		for _, item := range corpus.Items() {
+			res.Merge(item.Signal)
+		}
+		return res
+	}
+	assert.Equal(t, union(), corpus.Signal())
+	corpus.Minimize(true)
+	assert.Equal(t, union(), corpus.Signal())
+}
+
+func TestCorpusRemove(t *testing.T) {
+	corpus := NewCorpus(context.Background())
+	corpus.SetPrioMode(PrioRarity)
+	a, b := testProg("a"), testProg("b")
+	corpus.Save(NewInput{Prog: a, Signal: signal.FromRaw([]uint64{1, 2}, 0)})
+	// The program gains signal when it's saved again.
+	corpus.Save(NewInput{Prog: a, Signal: signal.FromRaw([]uint64{3}, 0)})
+	corpus.Save(NewInput{Prog: b, Signal: signal.FromRaw([]uint64{2}, 0)})
+	assert.Equal(t, map[uint64]int{1: 1, 2: 2, 3: 1}, corpus.edgeHits)
+
+	sig := hash.String(a.Serialize())
+	assert.True(t, corpus.Remove(sig))
+	assert.False(t, corpus.Remove(sig))
+	assert.Nil(t, corpus.Item(sig))
+	assert.Len(t, corpus.Items(), 1)
+	assert.Equal(t, []*prog.Prog{b}, corpus.Programs())
+	assert.Equal(t, signal.FromRaw([]uint64{2}, 0), corpus.Signal())
+	assert.Equal(t, 1, corpus.StatProgs.Val())
+	assert.Equal(t, 1, corpus.StatSignal.Val())
+	// All edges of the removed program are forgotten, including the ones it gained later.
+	assert.Equal(t, map[uint64]int{2: 1}, corpus.edgeHits)
+	assert.NoError(t, corpus.validate())
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, b, corpus.ChooseProgram(r))
+	}
+}
+
+func TestCorpusMerge(t *testing.T) {
+	corpus1, corpus2 := NewCorpus(context.Background()), NewCorpus(context.Background())
+	save := func(corpus *Corpus, name string, size int) *prog.Prog {
+		p := testProg(name)
+		corpus.Save(NewInput{Prog: p, Signal: makeSignal(size), Cover: []uint64{uint64(size)}})
+		return p
+	}
+	save(corpus1, "a", 1)
+	save(corpus1, "b", 2)
+	save(corpus2, "b", 5)
+	c := save(corpus2, "c", 3)
+	save(corpus2, "c", 4)
+	d := save(corpus2, "d", 6)
+	corpus2.SetPriority(c, 50)
+	corpus2.SetCost(d, 2)
+	corpus1.Merge(corpus2)
+	corpus1.Merge(corpus1)
+
+	var names []string
+	for _, p := range corpus1.Programs() {
+		names = append(names, string(p.Serialize()))
+	}
+	assert.Equal(t, []string{"a()\n", "b()\n", "c()\n", "d()\n"}, names)
+	assert.Len(t, corpus1.Items(), 4)
+	assert.Equal(t, makeSignal(6), corpus1.Signal())
+	assert.Equal(t, makeSignal(5), corpus1.Item(hash.String([]byte("b()\n"))).Signal)
+	// The priority of "b" is not changed, "c" and "d" keep their priority and cost.
+	assert.Equal(t, []int64{1, 2, 50, 6}, corpus1.priorities())
+	assert.Equal(t, int64(59), corpus1.SumPriorities())
+	corpus1.SetCostWeighting(true)
+	assert.Equal(t, int64(56), corpus1.SumPriorities())
+	assert.NoError(t, corpus1.validate())
+	// The source corpus is not changed.
+	assert.Len(t, corpus2.Programs(), 3)
+	assert.Equal(t, []uint64{6}, corpus2.Item(hash.String([]byte("d()\n"))).Cover)
+}
+
+func TestCorpusMergeRarity(t *testing.T) {
+	corpus1, corpus2 := NewCorpus(context.Background()), NewCorpus(context.Background())
+	corpus1.SetPrioMode(PrioRarity)
+	corpus2.SetPrioMode(PrioRarity)
+	corpus1.Save(NewInput{Prog: testProg("a"), Signal: signal.FromRaw([]uint64{1}, 0)})
+	corpus2.Save(NewInput{Prog: testProg("b"), Signal: signal.FromRaw([]uint64{1, 2}, 0)})
+	corpus1.Merge(corpus2)
+	// Edge 1 is covered by both programs in the merged corpus.
+	assert.Equal(t, []int64{rarityScale, rarityScale/2 + rarityScale}, corpus1.priorities())
+	assert.Equal(t, map[uint64]int{1: 2, 2: 1}, corpus1.edgeHits)
+	// Edges of the merged programs count for subsequently saved programs.
+	corpus1.Save(NewInput{Prog: testProg("c"), Signal: signal.FromRaw([]uint64{2}, 0)})
+	assert.Equal(t, int64(rarityScale/2), corpus1.priorities()[2])
+	assert.NoError(t, corpus1.validate())
+}
+
 func TestCorpusSaveConcurrency(t *testing.T) {
 	target := getTarget(t, targets.TestOS, targets.TestArch64)
 	corpus := NewCorpus(context.Background())
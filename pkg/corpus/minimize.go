@@ -7,6 +7,7 @@ import (
 	"sort"
 
 	"github.com/google/syzkaller/pkg/signal"
+	"github.com/google/syzkaller/prog"
 )
 
 func (corpus *Corpus) Minimize(cover bool) {
@@ -38,11 +39,17 @@ func (corpus *Corpus) Minimize(cover bool) {
 	})
 
 	corpus.progs = make(map[string]*Item)
-	programsList := &ProgramsList{}
+	programsList := corpus.ProgramsList.emptyCopy()
+	var progs []*prog.Prog
+	var signals []signal.Signal
 	for _, ctx := range signal.Minimize(inputs) {
 		inp := ctx.(*Item)
 		corpus.progs[inp.Sig] = inp
-		programsList.saveProgram(inp.Prog, inp.Signal)
+		progs = append(progs, inp.Prog)
+		signals = append(signals, inp.Signal)
+	}
+	programsList.savePrograms(progs, signals)
+	if err := corpus.ProgramsList.replace(programsList); err != nil {
+		panic(err) // the list is built from scratch above, so this is a bug in ProgramsList
 	}
-	corpus.ProgramsList.replace(programsList)
 }
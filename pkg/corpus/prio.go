@@ -4,7 +4,11 @@
 package corpus
 
 import (
+	"fmt"
+	"math"
+	"math/bits"
 	"math/rand"
+	"slices"
 	"sort"
 	"sync"
 
@@ -15,8 +19,64 @@ import (
 type ProgramsList struct {
 	mu       sync.RWMutex
 	progs    []*prog.Prog
+	index    map[*prog.Prog]int // position of each program in progs
+	prios    []int64            // priority of each program in progs
 	sumPrios int64
-	accPrios []int64
+	accPrios []int64 // prefix sums of prios
+	prioMode PrioMode
+	prioMin  int64                    // priorities are clamped to [max(prioMin, 1), prioMax]
+	prioMax  int64                    // 0 means no limit
+	prioMult func(*prog.Prog) float64 // multiplier of priorities, nil means 1
+	edgeHits map[uint64]int           // number of saved programs that cover each signal element, for PrioRarity
+	// Execution cost of programs (1 if not set), priorities are divided by it if costWeighting is set.
+	costs         map[*prog.Prog]float64
+	costWeighting bool
+	overrides     map[*prog.Prog]int64 // priorities set with SetPriority, they are kept by replace
+}
+
+// PrioMode says how priorities of programs are calculated.
+type PrioMode int
+
+const (
+	// PrioSignalLen: priority is the number of signal elements of the program.
+	PrioSignalLen PrioMode = iota
+	// PrioRarity: each signal element contributes rarityScale/N to the priority,
+	// where N is the number of saved programs that cover it (including this one).
+	// So a program that covers a single unique element outweighs a program that
+	// covers rarityScale-1 elements that are covered by all other programs.
+	// Priorities are calculated from the counts at the time programs are saved, and are
+	// recalculated from the current counts when the corpus is minimized. Until then a program
+	// that was the first to cover common elements keeps a high priority.
+	PrioRarity
+)
+
+const rarityScale = 1000
+
+// SetPrioMode sets how priorities of subsequently saved programs are calculated.
+// It's meant to be called before any programs are saved.
+func (pl *ProgramsList) SetPrioMode(mode PrioMode) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.prioMode = mode
+}
+
+// SetPrioBounds sets the range priorities of subsequently saved programs are clamped to.
+// The minimum is at least 1, and maxPrio 0 means no upper limit (the default).
+// An upper limit prevents programs with huge signal from dominating the selection.
+func (pl *ProgramsList) SetPrioBounds(minPrio, maxPrio int64) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.prioMin = minPrio
+	pl.prioMax = maxPrio
+}
+
+// SetPrioMultiplier sets a function that returns a multiplier for priorities of subsequently saved programs,
+// e.g. to prefer programs that call syscalls of interest regardless of the signal they produce.
+// The multiplier is applied before priorities are clamped to the bounds. nil means multiplier 1.
+func (pl *ProgramsList) SetPrioMultiplier(fn func(*prog.Prog) float64) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.prioMult = fn
 }
 
 func (pl *ProgramsList) ChooseProgram(r *rand.Rand) *prog.Prog {
@@ -25,35 +85,349 @@ func (pl *ProgramsList) ChooseProgram(r *rand.Rand) *prog.Prog {
 	if len(pl.progs) == 0 {
 		return nil
 	}
-	randVal := r.Int63n(pl.sumPrios + 1)
+	// Program i owns values in [accPrios[i-1], accPrios[i]), so it's chosen with probability prio/sumPrios.
+	// randVal is strictly less than sumPrios (there is no +1), so the largest value maps to the last program.
+	randVal := r.Int63n(pl.sumPrios)
 	idx := sort.Search(len(pl.accPrios), func(i int) bool {
-		return pl.accPrios[i] >= randVal
+		return pl.accPrios[i] > randVal
 	})
 	return pl.progs[idx]
 }
 
+// Programs returns a copy of the list of programs, so the caller can use it without holding the lock.
 func (pl *ProgramsList) Programs() []*prog.Prog {
 	pl.mu.RLock()
 	defer pl.mu.RUnlock()
-	return pl.progs
+	return slices.Clone(pl.progs)
+}
+
+// ForEach calls fn for each program until fn returns false.
+// It walks a snapshot of the list taken at the time of the call and doesn't hold the lock while calling fn,
+// so it doesn't block writers. Programs saved after the snapshot is taken are not visited.
+func (pl *ProgramsList) ForEach(fn func(*prog.Prog) bool) {
+	for _, p := range pl.Programs() {
+		if !fn(p) {
+			return
+		}
+	}
+}
+
+func (pl *ProgramsList) saveProgram(p *prog.Prog, sign signal.Signal) {
+	pl.savePrograms([]*prog.Prog{p}, []signal.Signal{sign})
 }
 
-func (pl *ProgramsList) saveProgram(p *prog.Prog, signal signal.Signal) {
+// savePrograms saves progs with the corresponding signals under a single lock,
+// which is cheaper than saving programs one by one when a lot of programs are loaded at once.
+// It's not exported since the programs must be saved via Corpus, which embeds the list.
+func (pl *ProgramsList) savePrograms(progs []*prog.Prog, signals []signal.Signal) {
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
-	prio := int64(len(signal))
-	if prio == 0 {
-		prio = 1
+	pl.accPrios = slices.Grow(pl.accPrios, len(progs))
+	pl.prios = slices.Grow(pl.prios, len(progs))
+	pl.progs = slices.Grow(pl.progs, len(progs))
+	if pl.prioMode == PrioRarity {
+		// Programs saved at once (e.g. by Minimize) get priorities calculated from the counts of all of them.
+		for _, sign := range signals {
+			pl.countEdges(sign)
+		}
 	}
-	pl.sumPrios += prio
-	pl.accPrios = append(pl.accPrios, pl.sumPrios)
+	for i, p := range progs {
+		prio := pl.calcPrio(p, signals[i])
+		pl.sumPrios += pl.selectionPrio(p, prio)
+		pl.accPrios = append(pl.accPrios, pl.sumPrios)
+		pl.prios = append(pl.prios, prio)
+		pl.appendProgram(p)
+	}
+}
+
+func (pl *ProgramsList) appendProgram(p *prog.Prog) {
+	if pl.index == nil {
+		pl.index = make(map[*prog.Prog]int)
+	}
+	pl.index[p] = len(pl.progs)
 	pl.progs = append(pl.progs, p)
 }
 
-func (pl *ProgramsList) replace(other *ProgramsList) {
+// indexOf returns the position of p in progs, or -1 if it's not in the list.
+func (pl *ProgramsList) indexOf(p *prog.Prog) int {
+	if idx, ok := pl.index[p]; ok {
+		return idx
+	}
+	return -1
+}
+
+// calcPrio returns the priority of the program, in PrioRarity mode its signal must be counted with countEdges.
+func (pl *ProgramsList) calcPrio(p *prog.Prog, signal signal.Signal) int64 {
+	var prio int64
+	switch pl.prioMode {
+	case PrioSignalLen:
+		prio = int64(len(signal))
+	case PrioRarity:
+		for _, elem := range signal.ToRaw() {
+			prio += rarityScale / int64(max(pl.edgeHits[elem], 1))
+		}
+	}
+	if pl.prioMult != nil {
+		prio = int64(math.Round(float64(prio) * pl.prioMult(p)))
+	}
+	if pl.prioMax != 0 {
+		prio = min(prio, pl.prioMax)
+	}
+	return max(prio, pl.prioMin, 1)
+}
+
+// countEdges counts the signal elements towards the number of programs covering them.
+func (pl *ProgramsList) countEdges(sign signal.Signal) {
+	if pl.edgeHits == nil {
+		pl.edgeHits = make(map[uint64]int)
+	}
+	for _, elem := range sign.ToRaw() {
+		pl.edgeHits[elem]++
+	}
+}
+
+// addEdges counts the signal a saved program has gained (when it's saved again) in PrioRarity mode.
+// Priorities are not updated until the corpus is minimized.
+func (pl *ProgramsList) addEdges(sign signal.Signal) {
 	pl.mu.Lock()
 	defer pl.mu.Unlock()
-	pl.sumPrios = other.sumPrios
-	pl.accPrios = other.accPrios
-	pl.progs = other.progs
+	if pl.prioMode == PrioRarity && !sign.Empty() {
+		pl.countEdges(sign)
+	}
+}
+
+// forgetEdges undoes countEdges for the signal.
+func (pl *ProgramsList) forgetEdges(sign signal.Signal) {
+	if pl.edgeHits == nil {
+		return
+	}
+	for _, elem := range sign.ToRaw() {
+		if pl.edgeHits[elem]--; pl.edgeHits[elem] <= 0 {
+			delete(pl.edgeHits, elem)
+		}
+	}
+}
+
+// SetPriority changes the priority of a saved program, e.g. to prefer a program that turned out
+// to be more valuable than its signal suggests. The priority is at least 1, bounds are not applied.
+// The priority is not recalculated from the signal when the corpus is minimized.
+// Returns false if p is not in the list.
+func (pl *ProgramsList) SetPriority(p *prog.Prog, prio int64) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	idx := pl.indexOf(p)
+	if idx == -1 {
+		return false
+	}
+	if pl.overrides == nil {
+		pl.overrides = make(map[*prog.Prog]int64)
+	}
+	pl.overrides[p] = max(prio, 1)
+	pl.prios[idx] = pl.overrides[p]
+	pl.recomputePriosFrom(idx)
+	return true
+}
+
+// SetCostWeighting enables discounting priorities of programs by their execution cost set with SetCost.
+// Programs are then selected according to prio/cost, so that slow programs don't reduce the throughput much,
+// but programs with high priorities are still preferred when they are cheap.
+func (pl *ProgramsList) SetCostWeighting(enabled bool) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.costWeighting = enabled
+	pl.recomputePrios()
+}
+
+// SetCost sets the execution cost of a saved program relative to other programs (e.g. its execution time
+// divided by the average one). The cost must be positive. Returns false if p is not in the list.
+// Only priorities of p and the following programs are recomputed (and only with cost weighting enabled),
+// so costs can be set for all programs without much overhead.
+func (pl *ProgramsList) SetCost(p *prog.Prog, cost float64) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	idx := pl.indexOf(p)
+	if cost <= 0 || idx == -1 {
+		return false
+	}
+	if pl.costs == nil {
+		pl.costs = make(map[*prog.Prog]float64)
+	}
+	pl.costs[p] = cost
+	if pl.costWeighting {
+		pl.recomputePriosFrom(idx)
+	}
+	return true
+}
+
+// selectionPrio returns the priority the program is selected with.
+func (pl *ProgramsList) selectionPrio(p *prog.Prog, prio int64) int64 {
+	cost, ok := pl.costs[p]
+	if !pl.costWeighting || !ok {
+		return prio
+	}
+	return max(int64(math.Round(float64(prio)/cost)), 1)
+}
+
+// removeProgram removes p with its signal from the list and returns whether it was present.
+// It's not exported since the program must be removed via Corpus.Remove, which passes the item signal.
+// In PrioRarity mode the signal no longer counts towards rarity of priorities of subsequently saved programs.
+func (pl *ProgramsList) removeProgram(p *prog.Prog, sign signal.Signal) bool {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	idx := pl.indexOf(p)
+	if idx == -1 {
+		return false
+	}
+	pl.progs = slices.Delete(pl.progs, idx, idx+1)
+	pl.prios = slices.Delete(pl.prios, idx, idx+1)
+	pl.accPrios = pl.accPrios[:len(pl.progs)]
+	delete(pl.costs, p)
+	delete(pl.overrides, p)
+	delete(pl.index, p)
+	pl.forgetEdges(sign)
+	for i := idx; i < len(pl.progs); i++ {
+		pl.index[pl.progs[i]] = i
+	}
+	pl.recomputePriosFrom(idx)
+	return true
+}
+
+// recomputePrios rebuilds sumPrios and accPrios from the per-program priorities and costs.
+// The caller must hold the write lock.
+func (pl *ProgramsList) recomputePrios() {
+	pl.sumPrios = 0
+	pl.accPrios = make([]int64, len(pl.prios))
+	for i, prio := range pl.prios {
+		pl.sumPrios += pl.selectionPrio(pl.progs[i], prio)
+		pl.accPrios[i] = pl.sumPrios
+	}
+}
+
+// recomputePriosFrom rebuilds accPrios starting from idx and sumPrios, e.g. after the priority
+// or the cost of the program at idx has changed. The caller must hold the write lock.
+func (pl *ProgramsList) recomputePriosFrom(idx int) {
+	var sum int64
+	if idx > 0 {
+		sum = pl.accPrios[idx-1]
+	}
+	for i := idx; i < len(pl.prios); i++ {
+		sum += pl.selectionPrio(pl.progs[i], pl.prios[i])
+		pl.accPrios[i] = sum
+	}
+	pl.sumPrios = sum
+}
+
+// SumPriorities returns the sum of priorities of all programs (discounted by costs with cost weighting).
+func (pl *ProgramsList) SumPriorities() int64 {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return pl.sumPrios
+}
+
+// PrioBucket is a priority histogram bucket: the number of programs with priorities in [Min, Max].
+type PrioBucket struct {
+	Min   int64
+	Max   int64
+	Count int
+}
+
+// PrioHistogram returns the distribution of program priorities over power-of-two ranges
+// ([1, 1], [2, 3], [4, 7], ...) in increasing order. Empty buckets are omitted.
+// It helps to see if the selection is dominated by a few programs with high priorities.
+func (pl *ProgramsList) PrioHistogram() []PrioBucket {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	counts := make(map[int]int)
+	for _, prio := range pl.prios {
+		counts[bits.Len64(uint64(prio))]++
+	}
+	var res []PrioBucket
+	for bit := 1; bit <= 64; bit++ {
+		if counts[bit] == 0 {
+			continue
+		}
+		res = append(res, PrioBucket{
+			Min:   int64(1) << (bit - 1),
+			Max:   int64(uint64(1)<<bit - 1),
+			Count: counts[bit],
+		})
+	}
+	return res
+}
+
+// priorities returns a copy of the per-program priorities in the order of Programs().
+func (pl *ProgramsList) priorities() []int64 {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return slices.Clone(pl.prios)
+}
+
+// emptyCopy returns an empty list with the same settings as pl.
+func (pl *ProgramsList) emptyCopy() *ProgramsList {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return &ProgramsList{
+		prioMode: pl.prioMode,
+		prioMin:  pl.prioMin,
+		prioMax:  pl.prioMax,
+		prioMult: pl.prioMult,
+		// Costs are taken over by replace, since they may change until then.
+		costWeighting: pl.costWeighting,
+	}
+}
+
+// replace makes pl use the programs and priorities of other. Costs and priorities set with SetPriority
+// of the programs that remain in the list are kept, including the ones set after other was created.
+// If other is inconsistent, pl is left intact and an error is returned,
+// otherwise ChooseProgram would panic or select programs incorrectly later.
+func (pl *ProgramsList) replace(other *ProgramsList) error {
+	if err := other.validate(); err != nil {
+		return err
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.edgeHits = other.edgeHits
+	// The slices are modified in place later, so they must not be shared with other.
+	pl.prios = slices.Clone(other.prios)
+	pl.progs = slices.Clone(other.progs)
+	pl.index = make(map[*prog.Prog]int, len(pl.progs))
+	costs := make(map[*prog.Prog]float64)
+	overrides := make(map[*prog.Prog]int64)
+	for i, p := range pl.progs {
+		pl.index[p] = i
+		if cost, ok := pl.costs[p]; ok {
+			costs[p] = cost
+		}
+		if prio, ok := pl.overrides[p]; ok {
+			overrides[p] = prio
+			pl.prios[i] = prio
+		}
+	}
+	pl.costs = costs
+	pl.overrides = overrides
+	pl.recomputePrios()
+	return nil
+}
+
+// validate checks that the per-program slices have the same length,
+// and that accPrios are prefix sums of prios with the last one equal to sumPrios.
+func (pl *ProgramsList) validate() error {
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	if len(pl.prios) != len(pl.progs) || len(pl.accPrios) != len(pl.progs) {
+		return fmt.Errorf("inconsistent programs list: %v programs, %v priorities, %v accumulated priorities",
+			len(pl.progs), len(pl.prios), len(pl.accPrios))
+	}
+	var sum int64
+	for i, prio := range pl.prios {
+		sum += pl.selectionPrio(pl.progs[i], prio)
+		if prio <= 0 || pl.accPrios[i] != sum {
+			return fmt.Errorf("inconsistent programs list: program %v has priority %v and accumulated priority %v,"+
+				" expected %v", i, prio, pl.accPrios[i], sum)
+		}
+	}
+	if sum != pl.sumPrios {
+		return fmt.Errorf("inconsistent programs list: sum of priorities is %v, expected %v", pl.sumPrios, sum)
+	}
+	return nil
 }
@@ -5,10 +5,13 @@ package corpus
 
 import (
 	"context"
+	"maps"
 	"math"
 	"math/rand"
+	"slices"
 	"testing"
 
+	"github.com/google/syzkaller/pkg/signal"
 	"github.com/google/syzkaller/prog"
 	"github.com/google/syzkaller/sys/targets"
 )
@@ -47,3 +50,676 @@ func TestChooseProgram(t *testing.T) {
 		}
 	}
 }
+
+func TestChooseProgramSmallPriorities(t *testing.T) {
+	// With small priorities an off-by-one in the search bounds noticeably skews selection frequencies.
+	pl := &ProgramsList{}
+	priorities := make(map[*prog.Prog]int64)
+	for _, prio := range []int64{1, 1, 1, 2, 5} {
+		p := testProg("read")
+		pl.saveProgram(p, nil)
+		pl.SetPriority(p, prio)
+		priorities[p] = prio
+	}
+	checkSelection(t, pl, priorities)
+}
+
+// constSource is a rand.Source that always returns the same value.
+type constSource int64
+
+func (s constSource) Int63() int64 { return int64(s) }
+func (s constSource) Seed(int64)   {}
+
+func TestChooseProgramBounds(t *testing.T) {
+	progs := []*prog.Prog{testProg("read"), testProg("read")}
+	pl := &ProgramsList{}
+	pl.saveProgram(progs[0], makeSignal(3))
+	pl.saveProgram(progs[1], makeSignal(5))
+	// With a power of 2 sum Int63n masks the source value, so these are the smallest and the largest values.
+	if p := pl.ChooseProgram(rand.New(constSource(0))); p != progs[0] {
+		t.Fatalf("the smallest random value is not mapped to the first program")
+	}
+	if p := pl.ChooseProgram(rand.New(constSource(math.MaxInt64))); p != progs[1] {
+		t.Fatalf("the largest random value is not mapped to the last program")
+	}
+}
+
+func TestChooseProgramEmpty(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	pl := &ProgramsList{}
+	if p := pl.ChooseProgram(r); p != nil {
+		t.Fatalf("got a program from an empty list")
+	}
+	p := &prog.Prog{}
+	pl.saveProgram(p, nil)
+	pl.removeProgram(p, nil)
+	if p := pl.ChooseProgram(r); p != nil {
+		t.Fatalf("got a program from a list with all programs removed")
+	}
+}
+
+func TestChooseProgramDeterministic(t *testing.T) {
+	pl := &ProgramsList{}
+	for i := 0; i < 100; i++ {
+		pl.saveProgram(&prog.Prog{}, makeSignal(i))
+	}
+	r1 := rand.New(rand.NewSource(42))
+	r2 := rand.New(rand.NewSource(42))
+	for it := 0; it < 1000; it++ {
+		p1, p2 := pl.ChooseProgram(r1), pl.ChooseProgram(r2)
+		if p1 != p2 {
+			t.Fatalf("iteration %v: selection diverged for identically seeded sources", it)
+		}
+	}
+}
+
+func TestRemoveProgram(t *testing.T) {
+	for _, remove := range [][]int{{0}, {5}, {9}, {0, 9, 5}, {0, 1, 2, 3, 4, 5, 6, 7, 8, 9}} {
+		pl := &ProgramsList{}
+		var progs []*prog.Prog
+		priorities := make(map[*prog.Prog]int64)
+		for i := 0; i < 10; i++ {
+			p := &prog.Prog{}
+			progs = append(progs, p)
+			priorities[p] = int64(10 * (i + 1))
+			pl.saveProgram(p, makeSignal(10*(i+1)))
+		}
+		for _, idx := range remove {
+			if !pl.removeProgram(progs[idx], makeSignal(10*(idx+1))) {
+				t.Fatalf("program %v was not found", idx)
+			}
+			if pl.removeProgram(progs[idx], makeSignal(10*(idx+1))) {
+				t.Fatalf("program %v was removed twice", idx)
+			}
+			delete(priorities, progs[idx])
+		}
+		if len(pl.progs) != len(priorities) || len(pl.accPrios) != len(priorities) {
+			t.Fatalf("removing %v: got %v programs and %v priorities, want %v",
+				remove, len(pl.progs), len(pl.accPrios), len(priorities))
+		}
+		var sum int64
+		prios := pl.priorities()
+		for i, p := range pl.progs {
+			if prios[i] != priorities[p] {
+				t.Fatalf("removing %v: prios[%v]=%v, want %v", remove, i, prios[i], priorities[p])
+			}
+			sum += priorities[p]
+			if pl.accPrios[i] != sum {
+				t.Fatalf("removing %v: accPrios[%v]=%v, want %v", remove, i, pl.accPrios[i], sum)
+			}
+		}
+		if pl.sumPrios != sum {
+			t.Fatalf("removing %v: sumPrios=%v, want %v", remove, pl.sumPrios, sum)
+		}
+		checkSelection(t, pl, priorities)
+	}
+}
+
+func TestRecomputePrios(t *testing.T) {
+	pl := &ProgramsList{}
+	for _, size := range []int{3, 0, 7, 1} {
+		pl.saveProgram(&prog.Prog{}, makeSignal(size))
+	}
+	if want := []int64{3, 1, 7, 1}; !slices.Equal(pl.priorities(), want) {
+		t.Fatalf("got priorities %v, want %v", pl.priorities(), want)
+	}
+	accPrios, sumPrios := slices.Clone(pl.accPrios), pl.sumPrios
+	pl.sumPrios, pl.accPrios = 0, nil
+	pl.recomputePrios()
+	if !slices.Equal(pl.accPrios, accPrios) || pl.sumPrios != sumPrios {
+		t.Fatalf("recomputed %v/%v, want %v/%v", pl.accPrios, pl.sumPrios, accPrios, sumPrios)
+	}
+	if want := []int64{3, 4, 11, 12}; !slices.Equal(accPrios, want) {
+		t.Fatalf("got accPrios %v, want %v", accPrios, want)
+	}
+}
+
+func TestPrioRarity(t *testing.T) {
+	common := makeSignal(10)
+	rare := signal.FromRaw([]uint64{1000}, 0)
+	selected := make(map[PrioMode]int)
+	for _, mode := range []PrioMode{PrioSignalLen, PrioRarity} {
+		pl := &ProgramsList{}
+		pl.SetPrioMode(mode)
+		var progs []*prog.Prog
+		var signals []signal.Signal
+		for i := 0; i < 20; i++ {
+			progs = append(progs, &prog.Prog{})
+			signals = append(signals, common)
+			pl.saveProgram(progs[i], common)
+		}
+		rareProg := &prog.Prog{}
+		progs = append(progs, rareProg)
+		signals = append(signals, rare)
+		pl.saveProgram(rareProg, rare)
+		// Minimization recalculates priorities from the current edge counts.
+		rebuilt := pl.emptyCopy()
+		rebuilt.savePrograms(progs, signals)
+		if err := pl.replace(rebuilt); err != nil {
+			t.Fatal(err)
+		}
+		prios := pl.priorities()
+		for i, prio := range prios[:20] {
+			switch mode {
+			case PrioSignalLen:
+				if prio != 10 || prios[20] != 1 {
+					t.Fatalf("unexpected priorities: %v", prios)
+				}
+			case PrioRarity:
+				// All common programs rank below the rare one, including the first one.
+				if prio != 10*rarityScale/20 || prio >= prios[20] || prios[20] != rarityScale {
+					t.Fatalf("program %v: unexpected priorities: %v", i, prios)
+				}
+			}
+		}
+		r := rand.New(rand.NewSource(0))
+		for i := 0; i < 100000; i++ {
+			if pl.ChooseProgram(r) == rareProg {
+				selected[mode]++
+			}
+		}
+	}
+	if selected[PrioRarity] < 5*selected[PrioSignalLen] {
+		t.Fatalf("the rare program is not preferred: selected %v times in rarity mode, %v times in length mode",
+			selected[PrioRarity], selected[PrioSignalLen])
+	}
+}
+
+func TestPrioRarityRemove(t *testing.T) {
+	pl := &ProgramsList{}
+	pl.SetPrioMode(PrioRarity)
+	p0, p1 := testProg("a"), testProg("b")
+	sign := signal.FromRaw([]uint64{1, 2}, 0)
+	pl.saveProgram(p0, sign)
+	pl.removeProgram(p0, sign)
+	// The removed program doesn't make the edges look common.
+	pl.saveProgram(p1, sign)
+	if want := []int64{2 * rarityScale}; !slices.Equal(pl.priorities(), want) {
+		t.Fatalf("got priorities %v, want %v", pl.priorities(), want)
+	}
+	if len(pl.edgeHits) != 2 {
+		t.Fatalf("got edge hits %v", pl.edgeHits)
+	}
+	pl.removeProgram(p1, sign)
+	if len(pl.edgeHits) != 0 {
+		t.Fatalf("edge hits are not dropped: %v", pl.edgeHits)
+	}
+}
+
+// checkSelection verifies that ChooseProgram selects programs according to their priorities.
+func checkSelection(t *testing.T, pl *ProgramsList, priorities map[*prog.Prog]int64) {
+	const (
+		iters = 100000
+		eps   = 0.01
+	)
+	r := rand.New(rand.NewSource(0))
+	counters := make(map[*prog.Prog]int)
+	for it := 0; it < iters; it++ {
+		p := pl.ChooseProgram(r)
+		if p == nil {
+			break
+		}
+		counters[p]++
+	}
+	var sum int64
+	for _, prio := range priorities {
+		sum += prio
+	}
+	for p := range counters {
+		if _, ok := priorities[p]; !ok {
+			t.Fatalf("selected a program that is not in the list")
+		}
+	}
+	for p, prio := range priorities {
+		prob := float64(prio) / float64(sum)
+		if diff := math.Abs(prob*iters - float64(counters[p])); diff > eps*iters {
+			t.Fatalf("the difference (%f) is higher than %f%%", diff, eps*100)
+		}
+	}
+}
+
+func testProg(call string) *prog.Prog {
+	return &prog.Prog{
+		Calls: []*prog.Call{{Meta: &prog.Syscall{Name: call}}},
+	}
+}
+
+func makeSignal(size int) signal.Signal {
+	var raw []uint64
+	for i := 1; i <= size; i++ {
+		raw = append(raw, uint64(i))
+	}
+	return signal.FromRaw(raw, 0)
+}
+
+func TestProgramsCopy(t *testing.T) {
+	pl := &ProgramsList{}
+	p0, p1 := testProg("a"), testProg("b")
+	pl.saveProgram(p0, makeSignal(1))
+	pl.saveProgram(p1, makeSignal(2))
+	progs := pl.Programs()
+	if !slices.Equal(progs, []*prog.Prog{p0, p1}) {
+		t.Fatalf("got %v programs", len(progs))
+	}
+	progs[0] = nil
+	progs = append(progs[:1], testProg("c"))
+	_ = progs
+	if got := pl.Programs(); !slices.Equal(got, []*prog.Prog{p0, p1}) {
+		t.Fatalf("modifying the returned slice changed the list")
+	}
+}
+
+func TestProgramsConcurrentSave(t *testing.T) {
+	pl := &ProgramsList{}
+	for i := 0; i < 10; i++ {
+		pl.saveProgram(&prog.Prog{}, makeSignal(1))
+	}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			pl.saveProgram(&prog.Prog{}, makeSignal(1))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, p := range pl.Programs() {
+			if p == nil {
+				t.Fatalf("got nil program")
+			}
+		}
+	}
+	<-done
+	if got := len(pl.Programs()); got != 1010 {
+		t.Fatalf("got %v programs, want 1010", got)
+	}
+}
+
+func TestPrioBounds(t *testing.T) {
+	pl := &ProgramsList{}
+	pl.SetPrioBounds(5, 100)
+	sizes := []int{0, 3, 50, 100, 1000, 100000}
+	want := []int64{5, 5, 50, 100, 100, 100}
+	priorities := make(map[*prog.Prog]int64)
+	for i, size := range sizes {
+		p := &prog.Prog{}
+		pl.saveProgram(p, makeSignal(size))
+		priorities[p] = want[i]
+	}
+	if got := pl.priorities(); !slices.Equal(got, want) {
+		t.Fatalf("got priorities %v, want %v", got, want)
+	}
+	checkSelection(t, pl, priorities)
+	// The settings are preserved by minimization.
+	if cp := pl.emptyCopy(); cp.prioMin != 5 || cp.prioMax != 100 {
+		t.Fatalf("bounds are not copied")
+	}
+}
+
+func TestPrioBoundsFairness(t *testing.T) {
+	// Share of selections of the program with huge signal.
+	hugeShare := func(maxPrio int64) float64 {
+		pl := &ProgramsList{}
+		pl.SetPrioBounds(0, maxPrio)
+		huge := &prog.Prog{}
+		pl.saveProgram(huge, makeSignal(10000))
+		for i := 0; i < 9; i++ {
+			pl.saveProgram(&prog.Prog{}, makeSignal(100))
+		}
+		r := rand.New(rand.NewSource(0))
+		hits := 0
+		const iters = 10000
+		for it := 0; it < iters; it++ {
+			if pl.ChooseProgram(r) == huge {
+				hits++
+			}
+		}
+		return float64(hits) / iters
+	}
+	unbounded, bounded := hugeShare(0), hugeShare(100)
+	if unbounded < 0.9 || bounded > 0.15 {
+		t.Fatalf("huge program share: %.2f without limit, %.2f with limit", unbounded, bounded)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	pl := &ProgramsList{}
+	var progs []*prog.Prog
+	for i := 0; i < 10; i++ {
+		p := &prog.Prog{}
+		progs = append(progs, p)
+		pl.saveProgram(p, makeSignal(1))
+	}
+	var visited []*prog.Prog
+	pl.ForEach(func(p *prog.Prog) bool {
+		visited = append(visited, p)
+		// Saving from the callback must not deadlock, and the new programs are not visited.
+		pl.saveProgram(&prog.Prog{}, makeSignal(1))
+		return true
+	})
+	if !slices.Equal(visited, progs) {
+		t.Fatalf("visited %v programs, want %v", len(visited), len(progs))
+	}
+	visited = nil
+	pl.ForEach(func(p *prog.Prog) bool {
+		visited = append(visited, p)
+		return len(visited) < 3
+	})
+	if !slices.Equal(visited, progs[:3]) {
+		t.Fatalf("iteration did not stop, visited %v programs", len(visited))
+	}
+}
+
+func TestForEachConcurrentSave(t *testing.T) {
+	pl := &ProgramsList{}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			pl.saveProgram(&prog.Prog{}, makeSignal(1))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		pl.ForEach(func(p *prog.Prog) bool {
+			if p == nil {
+				t.Fatalf("got nil program")
+			}
+			return true
+		})
+	}
+	<-done
+}
+
+func TestPrioHistogram(t *testing.T) {
+	pl := &ProgramsList{}
+	if got := pl.PrioHistogram(); len(got) != 0 || pl.SumPriorities() != 0 {
+		t.Fatalf("non-empty histogram for an empty list: %v", got)
+	}
+	var sum int64
+	for _, size := range []int{0, 1, 2, 3, 3, 9, 15, 1000} {
+		pl.saveProgram(&prog.Prog{}, makeSignal(size))
+		sum += max(int64(size), 1)
+	}
+	want := []PrioBucket{
+		{Min: 1, Max: 1, Count: 2},
+		{Min: 2, Max: 3, Count: 3},
+		{Min: 8, Max: 15, Count: 2},
+		{Min: 512, Max: 1023, Count: 1},
+	}
+	if got := pl.PrioHistogram(); !slices.Equal(got, want) {
+		t.Fatalf("got histogram %+v, want %+v", got, want)
+	}
+	if got := pl.SumPriorities(); got != sum {
+		t.Fatalf("got sum %v, want %v", got, sum)
+	}
+}
+
+func TestReplaceInconsistent(t *testing.T) {
+	pl := &ProgramsList{}
+	pl.saveProgram(testProg("a"), makeSignal(1))
+	tests := []func(other *ProgramsList){
+		func(other *ProgramsList) { other.progs = other.progs[:1] },
+		func(other *ProgramsList) { other.accPrios = append(other.accPrios, 10) },
+		func(other *ProgramsList) { other.accPrios[0], other.accPrios[1] = other.accPrios[1], other.accPrios[0] },
+		func(other *ProgramsList) { other.sumPrios++ },
+		func(other *ProgramsList) { other.prios[0] = 0 },
+	}
+	for i, corrupt := range tests {
+		other := &ProgramsList{}
+		other.saveProgram(testProg("b"), makeSignal(2))
+		other.saveProgram(testProg("c"), makeSignal(3))
+		corrupt(other)
+		if err := pl.replace(other); err == nil {
+			t.Fatalf("test %v: no error for inconsistent list", i)
+		}
+		// The list is left intact and usable.
+		if progs := pl.Programs(); len(progs) != 1 || pl.ChooseProgram(rand.New(rand.NewSource(0))) != progs[0] {
+			t.Fatalf("test %v: list is changed: %v", i, progs)
+		}
+	}
+	other := &ProgramsList{}
+	other.saveProgram(testProg("b"), makeSignal(2))
+	if err := pl.replace(other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrioMultiplier(t *testing.T) {
+	pl := &ProgramsList{}
+	pl.SetPrioMultiplier(func(p *prog.Prog) float64 {
+		for _, call := range p.Calls {
+			if call.Meta.Name == "io_uring_enter" {
+				return 2
+			}
+		}
+		return 1
+	})
+	priorities := make(map[*prog.Prog]int64)
+	for i, call := range []string{"read", "io_uring_enter", "write", "io_uring_enter"} {
+		p := testProg(call)
+		pl.saveProgram(p, makeSignal(10*(i+1)))
+		priorities[p] = int64(10 * (i + 1))
+		if call == "io_uring_enter" {
+			priorities[p] *= 2
+		}
+	}
+	if want := []int64{10, 40, 30, 80}; !slices.Equal(pl.priorities(), want) {
+		t.Fatalf("got priorities %v, want %v", pl.priorities(), want)
+	}
+	checkSelection(t, pl, priorities)
+	// The multiplier is applied before the bounds, and is preserved by minimization.
+	cp := pl.emptyCopy()
+	cp.SetPrioBounds(0, 50)
+	cp.saveProgram(testProg("io_uring_enter"), makeSignal(30))
+	cp.saveProgram(testProg("read"), makeSignal(30))
+	if want := []int64{50, 30}; !slices.Equal(cp.priorities(), want) {
+		t.Fatalf("got priorities %v, want %v", cp.priorities(), want)
+	}
+}
+
+func TestSetPriority(t *testing.T) {
+	pl := &ProgramsList{}
+	priorities := make(map[*prog.Prog]int64)
+	var progs []*prog.Prog
+	for i := 0; i < 4; i++ {
+		p := testProg("read")
+		pl.saveProgram(p, makeSignal(100))
+		priorities[p] = 100
+		progs = append(progs, p)
+	}
+	checkSelection(t, pl, priorities)
+	if !pl.SetPriority(progs[2], 700) {
+		t.Fatalf("program is not found")
+	}
+	priorities[progs[2]] = 700
+	checkSelection(t, pl, priorities)
+	if pl.SumPriorities() != 1000 {
+		t.Fatalf("got sum of priorities %v, want 1000", pl.SumPriorities())
+	}
+	pl.SetPriority(progs[0], -5)
+	if want := []int64{1, 100, 700, 100}; !slices.Equal(pl.priorities(), want) {
+		t.Fatalf("got priorities %v, want %v", pl.priorities(), want)
+	}
+	if pl.SetPriority(testProg("read"), 100) {
+		t.Fatalf("found a program that is not in the list")
+	}
+}
+
+func TestSetPriorityMinimize(t *testing.T) {
+	corpus := NewCorpus(context.Background())
+	var progs []*prog.Prog
+	for i, name := range []string{"a", "b", "c"} {
+		p := testProg(name)
+		progs = append(progs, p)
+		corpus.Save(NewInput{Prog: p, Signal: signal.FromRaw([]uint64{uint64(i)}, 1)})
+	}
+	// A program with the same signal as "a", but a lower signal priority, is dropped by minimization.
+	corpus.Save(NewInput{Prog: testProg("d"), Signal: signal.FromRaw([]uint64{0}, 0)})
+	corpus.SetPriority(progs[1], 100)
+	corpus.Minimize(false)
+	priorities := make(map[*prog.Prog]int64)
+	for i, p := range corpus.Programs() {
+		priorities[p] = corpus.priorities()[i]
+	}
+	if want := map[*prog.Prog]int64{progs[0]: 1, progs[1]: 100, progs[2]: 1}; !maps.Equal(priorities, want) {
+		t.Fatalf("got priorities %v, want %v", priorities, want)
+	}
+	checkSelection(t, corpus.ProgramsList, priorities)
+}
+
+func TestSavePrograms(t *testing.T) {
+	for _, mode := range []PrioMode{PrioSignalLen, PrioRarity} {
+		var progs []*prog.Prog
+		var signals []signal.Signal
+		for i := 0; i < 20; i++ {
+			progs = append(progs, testProg("read"))
+			signals = append(signals, makeSignal(i*7%11))
+		}
+		one, batch := &ProgramsList{}, &ProgramsList{}
+		for _, pl := range []*ProgramsList{one, batch} {
+			pl.SetPrioMode(mode)
+			pl.SetPrioBounds(2, 8)
+			pl.saveProgram(progs[0], signals[0])
+		}
+		for i := 1; i < len(progs); i++ {
+			one.saveProgram(progs[i], signals[i])
+		}
+		batch.savePrograms(progs[1:], signals[1:])
+		if !slices.Equal(one.progs, batch.progs) || !slices.Equal(one.prios, batch.prios) ||
+			!slices.Equal(one.accPrios, batch.accPrios) || one.sumPrios != batch.sumPrios {
+			t.Fatalf("mode %v: batch differs:\n%v %v\n%v %v", mode, one.prios, one.accPrios, batch.prios, batch.accPrios)
+		}
+	}
+}
+
+func BenchmarkSavePrograms(b *testing.B) {
+	const count = 100000
+	progs := make([]*prog.Prog, count)
+	signals := make([]signal.Signal, count)
+	for i := range progs {
+		progs[i] = &prog.Prog{}
+		signals[i] = signal.FromRaw([]uint64{uint64(i), uint64(i + 1)}, 0)
+	}
+	b.Run("one-by-one", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pl := &ProgramsList{}
+			for j, p := range progs {
+				pl.saveProgram(p, signals[j])
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pl := &ProgramsList{}
+			pl.savePrograms(progs, signals)
+		}
+	})
+}
+
+func TestCostWeighting(t *testing.T) {
+	pl := &ProgramsList{}
+	pl.SetCostWeighting(true)
+	cheap, slow := testProg("read"), testProg("read")
+	pl.saveProgram(cheap, makeSignal(1000))
+	pl.saveProgram(slow, makeSignal(1000))
+	if !pl.SetCost(slow, 4) || pl.SetCost(testProg("read"), 4) || pl.SetCost(cheap, 0) {
+		t.Fatalf("wrong SetCost results")
+	}
+	checkSelection(t, pl, map[*prog.Prog]int64{cheap: 1000, slow: 250})
+	if pl.SumPriorities() != 1250 || !slices.Equal(pl.priorities(), []int64{1000, 1000}) {
+		t.Fatalf("got sum %v, priorities %v", pl.SumPriorities(), pl.priorities())
+	}
+	// Costs survive minimization.
+	cp := pl.emptyCopy()
+	cp.savePrograms([]*prog.Prog{slow}, []signal.Signal{makeSignal(1000)})
+	if err := pl.replace(cp); err != nil {
+		t.Fatal(err)
+	}
+	if pl.SumPriorities() != 250 {
+		t.Fatalf("got sum %v after minimization, want 250", pl.SumPriorities())
+	}
+	pl.saveProgram(cheap, makeSignal(1000))
+	pl.SetCostWeighting(false)
+	checkSelection(t, pl, map[*prog.Prog]int64{cheap: 1000, slow: 1000})
+}
+
+func TestReplaceCosts(t *testing.T) {
+	pl := &ProgramsList{}
+	pl.SetCostWeighting(true)
+	p0, p1, p2 := testProg("a"), testProg("b"), testProg("c")
+	pl.savePrograms([]*prog.Prog{p0, p1, p2}, []signal.Signal{makeSignal(100), makeSignal(100), makeSignal(100)})
+	pl.SetCost(p0, 2)
+	pl.SetCost(p2, 2)
+	// Minimization builds a new list without holding the lock, costs may be set meanwhile.
+	cp := pl.emptyCopy()
+	cp.savePrograms([]*prog.Prog{p0, p1}, []signal.Signal{makeSignal(100), makeSignal(100)})
+	pl.SetCost(p1, 4)
+	if err := pl.replace(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := pl.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[*prog.Prog]float64{p0: 2, p1: 4}; !maps.Equal(pl.costs, want) {
+		t.Fatalf("got costs %v, want %v", pl.costs, want)
+	}
+	if pl.SumPriorities() != 75 {
+		t.Fatalf("got sum %v, want 75", pl.SumPriorities())
+	}
+	// The lists don't share costs.
+	pl.SetCost(p0, 1)
+	if len(cp.costs) != 0 {
+		t.Fatalf("costs are shared with the replacement list: %v", cp.costs)
+	}
+}
+
+func TestSetCostIncremental(t *testing.T) {
+	pl := &ProgramsList{}
+	var progs []*prog.Prog
+	for i := 0; i < 10; i++ {
+		p := testProg("read")
+		progs = append(progs, p)
+		pl.saveProgram(p, makeSignal(100*(i+1)))
+	}
+	// Without cost weighting costs don't affect the selection.
+	pl.SetCost(progs[3], 2)
+	if pl.SumPriorities() != 5500 {
+		t.Fatalf("got sum %v, want 5500", pl.SumPriorities())
+	}
+	pl.SetCostWeighting(true)
+	if pl.SumPriorities() != 5300 {
+		t.Fatalf("got sum %v, want 5300", pl.SumPriorities())
+	}
+	// Positions of the following programs are updated on removal.
+	pl.removeProgram(progs[1], makeSignal(200))
+	for i, cost := range map[int]float64{0: 2, 9: 10, 5: 3} {
+		if !pl.SetCost(progs[i], cost) {
+			t.Fatalf("program %v is not found", i)
+		}
+		if err := pl.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pl.SetCost(progs[1], 2) {
+		t.Fatalf("removed program is found")
+	}
+	if want := int64(50 + 300 + 200 + 500 + 200 + 700 + 800 + 900 + 100); pl.SumPriorities() != want {
+		t.Fatalf("got sum %v, want %v", pl.SumPriorities(), want)
+	}
+}
+
+func BenchmarkSetCost(b *testing.B) {
+	const count = 10000
+	pl := &ProgramsList{}
+	pl.SetCostWeighting(true)
+	var progs []*prog.Prog
+	for i := 0; i < count; i++ {
+		p := &prog.Prog{}
+		progs = append(progs, p)
+		pl.saveProgram(p, makeSignal(10))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Costs are usually set for recently executed programs, which are spread over the list.
+		pl.SetCost(progs[i%count], float64(i%3+1))
+	}
+}
@@ -4,7 +4,10 @@
 package fuzzer
 
 import (
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/syzkaller/pkg/signal"
 	"github.com/google/syzkaller/pkg/stat"
@@ -15,11 +18,29 @@ type Cover struct {
 	mu        sync.RWMutex
 	maxSignal signal.Signal // max signal ever observed (including flakes)
 	newSignal signal.Signal // newly identified max signal
+	limit     int           // max number of elements in maxSignal (0 means no limit)
+
+	lastGrowth time.Time        // when maxSignal last grew
+	now        func() time.Time // overridden in tests
+
+	snapshots bool                          // whether snapshot is published
+	snapshot  atomic.Pointer[signal.Signal] // immutable copy of maxSignal for lock-free readers
+
+	statMaxSignal *stat.Val
 }
 
 func newCover() *Cover {
-	cover := new(Cover)
-	stat.New("max signal", "Maximum fuzzing signal (including flakes)",
+	return newCoverWith(nil)
+}
+
+// newCoverWith creates Cover with the initial max signal (e.g. when resuming a fuzzing session).
+// The initial signal is not reported as new signal.
+func newCoverWith(initial signal.Signal) *Cover {
+	cover := &Cover{now: time.Now}
+	if len(initial) != 0 {
+		cover.maxSignal = initial.Copy()
+	}
+	cover.statMaxSignal = stat.New("max signal", "Maximum fuzzing signal (including flakes)",
 		stat.Graph("signal"), stat.LenOf(&cover.maxSignal, &cover.mu))
 	return cover
 }
@@ -29,7 +50,40 @@ func newCover() *Cover {
 func (cover *Cover) AddMaxSignal(sign signal.Signal) {
 	cover.mu.Lock()
 	defer cover.mu.Unlock()
-	cover.maxSignal.Merge(sign)
+	diff := cover.maxSignal.Diff(sign)
+	if diff.Empty() {
+		return
+	}
+	cover.maxSignal.Merge(diff)
+	if cover.trim() {
+		diff = diff.Intersection(cover.maxSignal)
+	}
+	if !diff.Empty() {
+		cover.lastGrowth = cover.now()
+	}
+	cover.publishSnapshot()
+}
+
+// Subtract removes signal that is no longer reachable (e.g. belongs to an unloaded module).
+// The removed signal will be reported as new again if it's observed later.
+func (cover *Cover) Subtract(sign signal.Signal) {
+	cover.mu.Lock()
+	defer cover.mu.Unlock()
+	cover.maxSignal.Subtract(sign)
+	cover.newSignal.Subtract(sign)
+	cover.publishSnapshot()
+}
+
+// Reset drops all known signal, everything observed afterwards is reported as new.
+// The max signal stat reads the length under the lock, so it reflects the reset immediately.
+// LastGrowth is set to the time of the reset, so that stalls are measured from the reset.
+func (cover *Cover) Reset() {
+	cover.mu.Lock()
+	defer cover.mu.Unlock()
+	cover.maxSignal = nil
+	cover.newSignal = nil
+	cover.lastGrowth = cover.now()
+	cover.publishSnapshot()
 }
 
 func (cover *Cover) addRawMaxSignal(signal []uint64, prio uint8) signal.Signal {
@@ -40,16 +94,130 @@ func (cover *Cover) addRawMaxSignal(signal []uint64, prio uint8) signal.Signal {
 		return diff
 	}
 	cover.maxSignal.Merge(diff)
+	if cover.trim() {
+		// Elements that were evicted right away are not new, otherwise they would be reported
+		// as new every time they are observed.
+		diff = diff.Intersection(cover.maxSignal)
+	}
 	cover.newSignal.Merge(diff)
+	if !diff.Empty() {
+		cover.lastGrowth = cover.now()
+	}
+	cover.publishSnapshot()
 	return diff
 }
 
+// SetMaxSignalLimit bounds the number of elements in max signal to limit (0 means no limit).
+// When max signal grows beyond the limit, elements with the lowest priorities are evicted
+// until it's 10% below the limit, so that the eviction (which scans all of max signal) is not done
+// on every addition. Evicted signal is reported as new again if it's observed later.
+func (cover *Cover) SetMaxSignalLimit(limit int) {
+	cover.mu.Lock()
+	defer cover.mu.Unlock()
+	cover.limit = limit
+	cover.trim()
+	cover.publishSnapshot()
+}
+
+// trim evicts elements from max signal if it exceeds the limit and returns whether it did.
+func (cover *Cover) trim() bool {
+	if cover.limit == 0 || len(cover.maxSignal) <= cover.limit {
+		return false
+	}
+	cover.maxSignal.Trim(cover.limit - cover.limit/10)
+	return true
+}
+
+// DiffOnly returns the part of the raw signal that is not in max signal yet,
+// i.e. what addRawMaxSignal would add, without changing the state.
+func (cover *Cover) DiffOnly(signal []uint64, prio uint8) signal.Signal {
+	cover.mu.RLock()
+	defer cover.mu.RUnlock()
+	return cover.maxSignal.DiffRaw(signal, prio)
+}
+
+// CoverStats is a point-in-time view of Cover.
+type CoverStats struct {
+	MaxSignal  int       // number of max signal elements
+	NewSignal  int       // number of elements that will be returned by the next GrabSignalDelta()
+	LastGrowth time.Time // when max signal last grew (zero if it never did)
+}
+
+// Stats returns all stats at once, so that they are consistent with each other.
+func (cover *Cover) Stats() CoverStats {
+	cover.mu.RLock()
+	defer cover.mu.RUnlock()
+	return CoverStats{
+		MaxSignal:  len(cover.maxSignal),
+		NewSignal:  len(cover.newSignal),
+		LastGrowth: cover.lastGrowth,
+	}
+}
+
+// LastGrowth returns the time when max signal last grew (zero if it never did).
+// It can be used to detect fuzzing stalls.
+func (cover *Cover) LastGrowth() time.Time {
+	cover.mu.RLock()
+	defer cover.mu.RUnlock()
+	return cover.lastGrowth
+}
+
 func (cover *Cover) CopyMaxSignal() signal.Signal {
 	cover.mu.RLock()
 	defer cover.mu.RUnlock()
 	return cover.maxSignal.Copy()
 }
 
+// EnableSnapshots makes Cover publish an immutable copy of max signal after every change,
+// so that monitoring can read it with MaxSignalSnapshot without contending with the fuzzer.
+// It makes changes of max signal more expensive.
+func (cover *Cover) EnableSnapshots() {
+	cover.mu.Lock()
+	defer cover.mu.Unlock()
+	cover.snapshots = true
+	cover.publishSnapshot()
+}
+
+// publishSnapshot must be called with the write lock held after every change of maxSignal.
+func (cover *Cover) publishSnapshot() {
+	if !cover.snapshots {
+		return
+	}
+	snapshot := cover.maxSignal.Copy()
+	cover.snapshot.Store(&snapshot)
+}
+
+// MaxSignalSnapshot returns max signal as of the last change without locking if snapshots are enabled.
+// The result is shared and must not be modified. Without snapshots it's the same as CopyMaxSignal.
+func (cover *Cover) MaxSignalSnapshot() signal.Signal {
+	if snapshot := cover.snapshot.Load(); snapshot != nil {
+		return *snapshot
+	}
+	return cover.CopyMaxSignal()
+}
+
+// Intersect returns the part of sign that is already covered by max signal
+// (with the same or higher priority). The result doesn't share storage with either set.
+func (cover *Cover) Intersect(sign signal.Signal) signal.Signal {
+	cover.mu.RLock()
+	defer cover.mu.RUnlock()
+	return sign.Intersection(cover.maxSignal)
+}
+
+// CopyNewSignal returns a copy of the signal that will be returned by the next GrabSignalDelta().
+func (cover *Cover) CopyNewSignal() signal.Signal {
+	cover.mu.RLock()
+	defer cover.mu.RUnlock()
+	return cover.newSignal.Copy()
+}
+
+// NewSignalLen returns the size of the signal that will be returned by the next GrabSignalDelta().
+func (cover *Cover) NewSignalLen() int {
+	cover.mu.RLock()
+	defer cover.mu.RUnlock()
+	return len(cover.newSignal)
+}
+
 func (cover *Cover) GrabSignalDelta() signal.Signal {
 	cover.mu.Lock()
 	defer cover.mu.Unlock()
@@ -57,3 +225,11 @@ func (cover *Cover) GrabSignalDelta() signal.Signal {
 	cover.newSignal = nil
 	return plus
 }
+
+// GrabRawSignalDelta is like GrabSignalDelta, but returns the new signal as sorted raw elements
+// (e.g. for external analysis tools). Priorities are dropped.
+func (cover *Cover) GrabRawSignalDelta() []uint64 {
+	raw := cover.GrabSignalDelta().ToRaw()
+	slices.Sort(raw)
+	return raw
+}
@@ -0,0 +1,309 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package fuzzer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/pkg/signal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoverSubtract(t *testing.T) {
+	cover := newCover()
+	cover.addRawMaxSignal([]uint64{1, 2, 3, 4}, 1)
+	assert.Equal(t, 4, cover.statMaxSignal.Val())
+
+	cover.Subtract(signal.FromRaw([]uint64{2, 3}, 1))
+	assert.Equal(t, 2, cover.statMaxSignal.Val())
+	assert.ElementsMatch(t, []uint64{1, 4}, cover.GrabSignalDelta().ToRaw())
+
+	diff := cover.addRawMaxSignal([]uint64{1, 2, 3, 4}, 1)
+	assert.ElementsMatch(t, []uint64{2, 3}, diff.ToRaw())
+	assert.Equal(t, 4, cover.statMaxSignal.Val())
+}
+
+func TestCoverCopyNewSignal(t *testing.T) {
+	cover := newCover()
+	cover.addRawMaxSignal([]uint64{1, 2, 3}, 1)
+	copied := cover.CopyNewSignal()
+	assert.ElementsMatch(t, []uint64{1, 2, 3}, copied.ToRaw())
+
+	// The copy is independent from the pending delta, and copying does not consume it.
+	copied.Merge(signal.FromRaw([]uint64{4}, 1))
+	cover.addRawMaxSignal([]uint64{5}, 1)
+	assert.ElementsMatch(t, []uint64{1, 2, 3, 5}, cover.GrabSignalDelta().ToRaw())
+	assert.Empty(t, cover.CopyNewSignal())
+}
+
+func TestCoverNewSignalLen(t *testing.T) {
+	cover := newCover()
+	assert.Equal(t, 0, cover.NewSignalLen())
+	cover.addRawMaxSignal([]uint64{1, 2, 3}, 1)
+	cover.addRawMaxSignal([]uint64{2, 3, 4}, 1)
+	assert.Equal(t, 4, cover.NewSignalLen())
+	assert.Equal(t, 4, cover.NewSignalLen())
+	cover.GrabSignalDelta()
+	assert.Equal(t, 0, cover.NewSignalLen())
+}
+
+func TestCoverReset(t *testing.T) {
+	cover := newCover()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cover.now = func() time.Time { return now }
+	cover.addRawMaxSignal([]uint64{1, 2, 3}, 1)
+	cover.AddMaxSignal(signal.FromRaw([]uint64{4}, 1))
+	assert.Equal(t, 4, cover.statMaxSignal.Val())
+
+	now = now.Add(time.Hour)
+	cover.Reset()
+	assert.Equal(t, 0, cover.statMaxSignal.Val())
+	assert.Equal(t, 0, cover.NewSignalLen())
+	assert.Equal(t, now, cover.LastGrowth())
+
+	diff := cover.addRawMaxSignal([]uint64{1, 2, 3, 4}, 1)
+	assert.ElementsMatch(t, []uint64{1, 2, 3, 4}, diff.ToRaw())
+	assert.Equal(t, 4, cover.statMaxSignal.Val())
+}
+
+func TestCoverShareMaxSignal(t *testing.T) {
+	local := newCover()
+	local.addRawMaxSignal([]uint64{1, 2, 3}, 1)
+	local.addRawMaxSignal([]uint64{3, 4}, 2)
+	data := local.CopyMaxSignal().Serialize()
+
+	remote := newCover()
+	remote.addRawMaxSignal([]uint64{1, 5}, 2)
+	sign, err := signal.Deserialize(data)
+	assert.NoError(t, err)
+	remote.AddMaxSignal(sign)
+	want := signal.FromRaw([]uint64{1, 3, 4, 5}, 2)
+	want.Merge(signal.FromRaw([]uint64{2}, 1))
+	assert.Equal(t, want, remote.CopyMaxSignal())
+}
+
+func TestCoverLastGrowth(t *testing.T) {
+	cover := newCover()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cover.now = func() time.Time { return now }
+	assert.True(t, cover.LastGrowth().IsZero())
+
+	cover.addRawMaxSignal([]uint64{1, 2}, 1)
+	assert.Equal(t, now, cover.LastGrowth())
+	start := now
+
+	now = now.Add(time.Minute)
+	cover.addRawMaxSignal([]uint64{1, 2}, 1)
+	cover.AddMaxSignal(signal.FromRaw([]uint64{2}, 0))
+	assert.Equal(t, start, cover.LastGrowth(), "no new signal")
+
+	now = now.Add(time.Minute)
+	cover.addRawMaxSignal([]uint64{2}, 2)
+	assert.Equal(t, now, cover.LastGrowth(), "higher priority")
+
+	now = now.Add(time.Minute)
+	cover.AddMaxSignal(signal.FromRaw([]uint64{3}, 1))
+	assert.Equal(t, now, cover.LastGrowth(), "new signal")
+}
+
+func TestCoverStats(t *testing.T) {
+	cover := newCover()
+	// Every call adds one element and advances the time by a second (under the lock),
+	// so all stats must correspond to the same number of calls.
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ticks := 0
+	cover.now = func() time.Time {
+		ticks++
+		return start.Add(time.Duration(ticks) * time.Second)
+	}
+	assert.Equal(t, CoverStats{}, cover.Stats())
+	const iters = 1000
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < iters; i++ {
+			cover.addRawMaxSignal([]uint64{uint64(i)}, 1)
+		}
+		close(done)
+	}()
+	check := func() {
+		stats := cover.Stats()
+		assert.Equal(t, stats.MaxSignal, stats.NewSignal)
+		if stats.MaxSignal != 0 {
+			assert.Equal(t, start.Add(time.Duration(stats.MaxSignal)*time.Second), stats.LastGrowth)
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		check()
+	}
+	assert.Equal(t, iters, cover.Stats().MaxSignal)
+	cover.GrabSignalDelta()
+	assert.Equal(t, 0, cover.Stats().NewSignal)
+}
+
+func TestCoverIntersect(t *testing.T) {
+	cover := newCover()
+	cover.addRawMaxSignal([]uint64{1, 2, 3, 4}, 1)
+	cover.addRawMaxSignal([]uint64{5}, 0)
+
+	other := signal.FromRaw([]uint64{3, 4, 6, 7}, 1)
+	other.Merge(signal.FromRaw([]uint64{5}, 1))
+	other.Merge(signal.FromRaw([]uint64{2}, 0))
+	shared := cover.Intersect(other)
+	// 5 is covered with a lower priority.
+	want := signal.FromRaw([]uint64{3, 4}, 1)
+	want.Merge(signal.FromRaw([]uint64{2}, 0))
+	assert.Equal(t, want, shared)
+
+	// The result is a fresh copy.
+	shared.Merge(signal.FromRaw([]uint64{100}, 1))
+	assert.Equal(t, 5, cover.statMaxSignal.Val())
+	assert.Equal(t, 6, other.Len())
+	assert.Empty(t, cover.Intersect(nil))
+}
+
+func TestCoverDiffOnly(t *testing.T) {
+	cover := newCover()
+	cover.addRawMaxSignal([]uint64{1, 2, 3}, 1)
+	cover.GrabSignalDelta()
+	lastGrowth := cover.LastGrowth()
+	for i := 0; i < 2; i++ {
+		diff := cover.DiffOnly([]uint64{2, 3, 4, 5}, 1)
+		assert.ElementsMatch(t, []uint64{4, 5}, diff.ToRaw())
+		assert.Equal(t, 3, cover.statMaxSignal.Val())
+		assert.Equal(t, 0, cover.NewSignalLen())
+		assert.Equal(t, lastGrowth, cover.LastGrowth())
+	}
+	// Higher priority of the known signal is new as well.
+	assert.ElementsMatch(t, []uint64{1}, cover.DiffOnly([]uint64{1}, 2).ToRaw())
+	assert.ElementsMatch(t, []uint64{2, 3, 4, 5}, cover.addRawMaxSignal([]uint64{2, 3, 4, 5}, 2).ToRaw())
+}
+
+func TestCoverWith(t *testing.T) {
+	initial := signal.FromRaw([]uint64{1, 2, 3}, 1)
+	cover := newCoverWith(initial)
+	assert.Equal(t, 3, cover.statMaxSignal.Val())
+	assert.Equal(t, 0, cover.NewSignalLen())
+	assert.True(t, cover.LastGrowth().IsZero())
+
+	assert.True(t, cover.addRawMaxSignal([]uint64{2}, 1).Empty())
+	assert.ElementsMatch(t, []uint64{4}, cover.addRawMaxSignal([]uint64{3, 4}, 1).ToRaw())
+	assert.ElementsMatch(t, []uint64{4}, cover.GrabSignalDelta().ToRaw())
+	// The initial signal is copied.
+	assert.Equal(t, 3, initial.Len())
+}
+
+func TestCoverGrabRawSignalDelta(t *testing.T) {
+	cover := newCover()
+	assert.Empty(t, cover.GrabRawSignalDelta())
+	cover.addRawMaxSignal([]uint64{30, 10, 20}, 1)
+	cover.addRawMaxSignal([]uint64{20, 5, 40}, 2)
+	assert.Equal(t, []uint64{5, 10, 20, 30, 40}, cover.GrabRawSignalDelta())
+	assert.Equal(t, 0, cover.NewSignalLen())
+	assert.Empty(t, cover.GrabRawSignalDelta())
+	assert.Equal(t, 5, cover.statMaxSignal.Val())
+}
+
+func TestCoverMaxSignalLimit(t *testing.T) {
+	cover := newCover()
+	cover.SetMaxSignalLimit(10)
+	cover.addRawMaxSignal([]uint64{1, 2, 3, 4, 5}, 2)
+	cover.addRawMaxSignal([]uint64{6, 7, 8, 9, 10}, 1)
+	assert.Equal(t, 10, cover.statMaxSignal.Val())
+	cover.GrabSignalDelta()
+
+	// Exceeding the limit evicts the lowest priority edges down to 90% of the limit.
+	// Edges that are evicted right away are not reported as new.
+	diff := cover.addRawMaxSignal([]uint64{11, 12}, 0)
+	assert.True(t, diff.Empty())
+	assert.True(t, cover.GrabSignalDelta().Empty())
+	assert.Equal(t, 9, cover.statMaxSignal.Val())
+	assert.Equal(t, 2, cover.DiffOnly([]uint64{11, 12}, 0).Len())
+
+	// No eviction below the limit.
+	diff = cover.addRawMaxSignal([]uint64{11}, 2)
+	assert.ElementsMatch(t, []uint64{11}, diff.ToRaw())
+	assert.Equal(t, 10, cover.statMaxSignal.Val())
+
+	// High priority edges are retained.
+	diff = cover.addRawMaxSignal([]uint64{20}, 2)
+	assert.ElementsMatch(t, []uint64{20}, diff.ToRaw())
+	assert.Equal(t, 9, cover.statMaxSignal.Val())
+	high := signal.FromRaw([]uint64{1, 2, 3, 4, 5, 11, 20}, 2)
+	assert.Equal(t, high.Len(), cover.CopyMaxSignal().Intersection(high).Len())
+	assert.ElementsMatch(t, []uint64{11, 20}, cover.GrabSignalDelta().ToRaw())
+
+	// No limit.
+	cover.SetMaxSignalLimit(0)
+	cover.addRawMaxSignal([]uint64{30, 31, 32}, 0)
+	assert.Equal(t, 12, cover.statMaxSignal.Val())
+}
+
+func TestCoverSnapshots(t *testing.T) {
+	cover := newCover()
+	cover.addRawMaxSignal([]uint64{1, 2}, 1)
+	assert.Equal(t, 2, cover.MaxSignalSnapshot().Len())
+	cover.EnableSnapshots()
+	snapshot := cover.MaxSignalSnapshot()
+	assert.Equal(t, 2, snapshot.Len())
+
+	cover.addRawMaxSignal([]uint64{3}, 1)
+	cover.AddMaxSignal(signal.FromRaw([]uint64{4}, 1))
+	assert.Equal(t, 2, snapshot.Len(), "published snapshots must not change")
+	assert.ElementsMatch(t, []uint64{1, 2, 3, 4}, cover.MaxSignalSnapshot().ToRaw())
+
+	cover.Subtract(signal.FromRaw([]uint64{1}, 1))
+	assert.ElementsMatch(t, []uint64{2, 3, 4}, cover.MaxSignalSnapshot().ToRaw())
+	cover.Reset()
+	assert.Equal(t, 0, cover.MaxSignalSnapshot().Len())
+}
+
+func BenchmarkCoverMonitor(b *testing.B) {
+	for _, snapshots := range []bool{false, true} {
+		b.Run(fmt.Sprintf("snapshots=%v", snapshots), func(b *testing.B) {
+			cover := newCover()
+			var raw []uint64
+			for i := 0; i < 100000; i++ {
+				raw = append(raw, uint64(i))
+			}
+			cover.addRawMaxSignal(raw, 1)
+			if snapshots {
+				cover.EnableSnapshots()
+			}
+			stop := make(chan bool)
+			done := make(chan bool)
+			go func() {
+				defer close(done)
+				for elem := uint64(len(raw)); ; elem++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					cover.addRawMaxSignal([]uint64{elem}, 1)
+					time.Sleep(time.Millisecond)
+				}
+			}()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if snapshots {
+						_ = cover.MaxSignalSnapshot().Len()
+					} else {
+						_ = cover.CopyMaxSignal().Len()
+					}
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -65,7 +65,8 @@ func Run(timeout time.Duration, cmd *exec.Cmd) ([]byte, error) {
 	close(done)
 	if err != nil {
 		text := fmt.Sprintf("failed to run %q: %v", cmd.Args, err)
-		if <-timedout {
+		isTimedout := <-timedout
+		if isTimedout {
 			text = fmt.Sprintf("timedout after %v %q", timeout, cmd.Args)
 		}
 		exitCode := 0
@@ -79,6 +80,7 @@ func Run(timeout time.Duration, cmd *exec.Cmd) ([]byte, error) {
 			Title:    text,
 			Output:   output.Bytes(),
 			ExitCode: exitCode,
+			Timedout: isTimedout,
 		}
 	}
 	return output.Bytes(), nil
@@ -113,6 +115,7 @@ type VerboseError struct {
 	Title    string
 	Output   []byte
 	ExitCode int
+	Timedout bool // the command was killed by Run because it exceeded the timeout
 }
 
 func (err *VerboseError) Error() string {
@@ -4,6 +4,13 @@
 // Package signal provides types for working with feedback signal.
 package signal
 
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
 type (
 	elemType uint64
 	prioType int8
@@ -140,6 +147,34 @@ func (s *Signal) Subtract(s1 Signal) {
 	}
 }
 
+// Trim removes elements with the lowest priorities, so that at most limit elements remain.
+// Elements with equal priorities are removed in unspecified order.
+func (s Signal) Trim(limit int) {
+	excess := len(s) - limit
+	if excess <= 0 {
+		return
+	}
+	var counts [256]int
+	for _, p := range s {
+		counts[int(p)-math.MinInt8]++
+	}
+	// All elements with priorities below the threshold are removed, and some with the threshold priority.
+	threshold, below := 0, 0
+	for ; below+counts[threshold] < excess; threshold++ {
+		below += counts[threshold]
+	}
+	atThreshold := excess - below
+	for e, p := range s {
+		switch idx := int(p) - math.MinInt8; {
+		case idx < threshold:
+			delete(s, e)
+		case idx == threshold && atThreshold > 0:
+			delete(s, e)
+			atThreshold--
+		}
+	}
+}
+
 // FilterRaw returns a subset of original raw elements that either are not present in ignore,
 // or coincides with the one in alwaysTake.
 func FilterRaw(raw []uint64, ignore, alwaysTake Signal) []uint64 {
@@ -183,6 +218,58 @@ func (s Signal) ToRaw() []uint64 {
 	return raw
 }
 
+// Serialize returns a compact encoding of the signal suitable for sending to other fuzzer instances.
+// Elements are sorted and delta-encoded, each is followed by its priority.
+func (s Signal) Serialize() []byte {
+	elems := make([]elemType, 0, len(s))
+	for e := range s {
+		elems = append(elems, e)
+	}
+	sort.Slice(elems, func(i, j int) bool { return elems[i] < elems[j] })
+	data := binary.AppendUvarint(nil, uint64(len(elems)))
+	prev := elemType(0)
+	for _, e := range elems {
+		data = binary.AppendUvarint(data, uint64(e-prev))
+		data = append(data, byte(s[e]))
+		prev = e
+	}
+	return data
+}
+
+// Deserialize decodes signal encoded with Serialize.
+// The data may come from other fuzzer instances, so malformed data is rejected
+// rather than decoded into something that differs from what was serialized.
+func Deserialize(data []byte) (Signal, error) {
+	n, size := binary.Uvarint(data)
+	// Each element takes at least 2 bytes: the delta and the priority.
+	if size <= 0 || n > uint64(len(data)-size)/2 {
+		return nil, fmt.Errorf("bad signal header")
+	}
+	data = data[size:]
+	s := make(Signal, n)
+	prev := elemType(0)
+	for i := uint64(0); i < n; i++ {
+		delta, size := binary.Uvarint(data)
+		if size <= 0 || size >= len(data) {
+			return nil, fmt.Errorf("truncated signal data at element %v", i)
+		}
+		// Elements are sorted and unique, only the first one (if it's 0) has a zero delta.
+		if delta == 0 && i != 0 {
+			return nil, fmt.Errorf("zero delta at signal element %v", i)
+		}
+		if delta > uint64(^prev) {
+			return nil, fmt.Errorf("signal element %v overflows", i)
+		}
+		prev += elemType(delta)
+		s[prev] = prioType(data[size])
+		data = data[size+1:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%v bytes of trailing signal data", len(data))
+	}
+	return s, nil
+}
+
 type Context struct {
 	Signal  Signal
 	Context interface{}
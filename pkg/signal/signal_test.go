@@ -4,6 +4,7 @@
 package signal
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,3 +26,56 @@ func TestIntersectsWith(t *testing.T) {
 	// The other signal has a lower priority.
 	assert.False(t, base.IntersectsWith(FromRaw([]uint64{0, 1, 2}, 0)))
 }
+
+func TestSerialize(t *testing.T) {
+	s := FromRaw([]uint64{0, 1, 1000, 1 << 40, ^uint64(0)}, 3)
+	s.Merge(FromRaw([]uint64{5, 1 << 32}, 1))
+	s.Merge(FromRaw([]uint64{6}, 0))
+	data := s.Serialize()
+	got, err := Deserialize(data)
+	assert.NoError(t, err)
+	assert.Equal(t, s, got)
+
+	empty, err := Deserialize(Signal(nil).Serialize())
+	assert.NoError(t, err)
+	assert.True(t, empty.Empty())
+
+	for i := 0; i < len(data); i++ {
+		_, err := Deserialize(data[:i])
+		assert.Error(t, err, "truncated to %v bytes", i)
+	}
+	_, err = Deserialize(append(data, 0))
+	assert.Error(t, err)
+
+	// Zero deltas would decode into fewer elements than the header says.
+	_, err = Deserialize([]byte{2, 5, 1, 0, 1})
+	assert.ErrorContains(t, err, "zero delta at signal element 1")
+	// So would deltas that overflow the element.
+	overflow := binary.AppendUvarint([]byte{2, 5, 1}, ^uint64(0)-1)
+	_, err = Deserialize(append(overflow, 1))
+	assert.ErrorContains(t, err, "signal element 1 overflows")
+	// The count must fit into the payload.
+	_, err = Deserialize(binary.AppendUvarint(nil, 1<<40))
+	assert.ErrorContains(t, err, "bad signal header")
+	_, err = Deserialize([]byte{3, 1, 1, 1, 1})
+	assert.ErrorContains(t, err, "bad signal header")
+}
+
+func TestTrim(t *testing.T) {
+	s := FromRaw([]uint64{1, 2, 3, 4}, 0)
+	s.Merge(FromRaw([]uint64{5, 6}, 1))
+	s.Merge(FromRaw([]uint64{7}, 2))
+	s.Trim(10)
+	assert.Equal(t, 7, s.Len())
+
+	s.Trim(4)
+	assert.Equal(t, 4, s.Len())
+	// All high priority elements are retained.
+	assert.True(t, s.Intersection(FromRaw([]uint64{5, 6}, 1)).Len() == 2)
+	assert.True(t, s.Intersection(FromRaw([]uint64{7}, 2)).Len() == 1)
+
+	s.Trim(1)
+	assert.Equal(t, []uint64{7}, s.ToRaw())
+	s.Trim(0)
+	assert.True(t, s.Empty())
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+// The cache stores extraction results of individual files keyed by the file contents,
+// the compile command and the extractor binary, so that unchanged files are not recompiled.
+// Note: changes in included headers are not detected.
+
+func (ex *extractor) initCache(dir string) error {
+	if err := osutil.MkdirAll(dir); err != nil {
+		return err
+	}
+	binary, err := os.ReadFile(ex.binary)
+	if err != nil {
+		return err
+	}
+	ex.cacheDir = dir
+	ex.binaryHash = []byte(hash.String(binary))
+	return nil
+}
+
+func (ex *extractor) cacheKey(cmd compileCommand) string {
+	if ex.cacheDir == "" {
+		return ""
+	}
+	file := cmd.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(cmd.Directory, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	// The key includes the effective compile command, entries without arguments have a command string.
+	command := strings.Join(append([]string{cmd.Directory, cmd.File}, cmd.args()...), "\x00")
+	// The environment and extractor flags can affect the results too.
+	env := strings.Join(ex.env, "\x00")
+	flags := fmt.Sprintf("types=%v", ex.types)
+	return hash.String(ex.binaryHash, data, []byte(command), []byte(env), []byte(flags))
+}
+
+func (ex *extractor) cacheLookup(key string) (output, bool) {
+	if key == "" {
+		return output{}, false
+	}
+	data, err := os.ReadFile(filepath.Join(ex.cacheDir, key))
+	if err != nil {
+		return output{}, false
+	}
+	return output{stdout: string(data), cached: true}, true
+}
+
+func (ex *extractor) cacheStore(key string, out output) {
+	if key == "" {
+		return
+	}
+	// The cache is best-effort, failure to store a result only means it will be recomputed next time.
+	osutil.WriteFile(filepath.Join(ex.cacheDir, key), []byte(out.stdout))
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "counter")
+	ex := &extractor{
+		binary:  fakeExtractor(t, `echo run >> `+counter+`; cat "$3"`),
+		timeout: time.Minute,
+	}
+	if err := ex.initCache(filepath.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a.c"), "read$auto() (automatic)\n")
+	cmd := compileCommand{
+		Directory: dir,
+		File:      filepath.Join(dir, "a.c"),
+		Arguments: []string{"gcc", "-c", "a.c"},
+	}
+	runs := func() int {
+		data, _ := os.ReadFile(counter)
+		return strings.Count(string(data), "run")
+	}
+	check := func(cmd compileCommand, wantCached bool, wantRuns int, wantStdout string) {
+		t.Helper()
+		out := ex.run(cmd)
+		if out.file != cmd.File || out.stderr != "" || out.stdout != wantStdout || out.cached != wantCached {
+			t.Fatalf("unexpected output: %+v", out)
+		}
+		if got := runs(); got != wantRuns {
+			t.Fatalf("extractor ran %v times, want %v", got, wantRuns)
+		}
+	}
+	check(cmd, false, 1, "read$auto() (automatic)\n")
+	check(cmd, true, 1, "read$auto() (automatic)\n")
+	// Changed compile flags invalidate the cache.
+	cmd.Arguments = []string{"gcc", "-O2", "-c", "a.c"}
+	check(cmd, false, 2, "read$auto() (automatic)\n")
+	check(cmd, true, 2, "read$auto() (automatic)\n")
+	// Changed contents invalidate the cache.
+	writeFile(t, filepath.Join(dir, "a.c"), "write$auto() (automatic)\n")
+	check(cmd, false, 3, "write$auto() (automatic)\n")
+	check(cmd, true, 3, "write$auto() (automatic)\n")
+	// So do changed flags in command strings.
+	for i, command := range []string{"gcc -c a.c", "gcc -DFOO -c a.c"} {
+		cmds, err := parseCompilationDatabase(strings.NewReader(fmt.Sprintf(`[{"command": %q, "directory": %q, "file": %q}]`,
+			command, dir, cmd.File)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(cmds[0], false, 4+i, "write$auto() (automatic)\n")
+		check(cmds[0], true, 4+i, "write$auto() (automatic)\n")
+	}
+	cmd.Arguments = nil
+	cmd.Command = "gcc -DBAR -c a.c"
+	check(cmd, false, 6, "write$auto() (automatic)\n")
+	check(cmd, true, 6, "write$auto() (automatic)\n")
+	// And extractor flags.
+	ex.types = true
+	check(cmd, false, 7, "write$auto() (automatic)\n")
+	check(cmd, true, 7, "write$auto() (automatic)\n")
+}
+
+func TestCacheFailuresNotStored(t *testing.T) {
+	dir := t.TempDir()
+	ex := &extractor{
+		binary:  fakeExtractor(t, "echo error >&2; exit 1"),
+		timeout: time.Minute,
+	}
+	if err := ex.initCache(filepath.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "a.c"), "")
+	cmd := compileCommand{Directory: dir, File: "a.c"}
+	for i := 0; i < 2; i++ {
+		if out := ex.run(cmd); out.cached || out.stderr == "" {
+			t.Fatalf("run #%v: unexpected output: %+v", i, out)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+// defaultExcludeFiles are generated files and userspace tools that don't contain syscall descriptions.
+var defaultExcludeFiles = []string{
+	"*.mod.c",
+	"scripts/",
+	"tools/",
+	"usr/",
+}
+
+// defaultStripFlags are GCC-only flags used by kernel builds that the Clang-based extractor rejects.
+// Flags ending with '*' match any flag with the prefix.
+var defaultStripFlags = []string{
+	"-fconserve-stack",
+	"-fmin-function-alignment=*",
+	"-fno-allow-store-data-races",
+	"-fno-ipa-sra",
+	"-fno-var-tracking-assignments",
+	"-fplugin-arg-*",
+	"-fplugin=*",
+	"-fsanitize=bounds-strict",
+	"-mfunction-return=*",
+	"-mindirect-branch-register",
+	"-mindirect-branch=*",
+	"-mno-fp-ret-in-387",
+	"-mpreferred-stack-boundary=*",
+	"-mrecord-mcount",
+	"-mskip-rax-setup",
+	"-Wimplicit-fallthrough=*",
+	"-Wno-alloc-size-larger-than",
+	"-Wno-format-truncation",
+	"-Wno-maybe-uninitialized",
+	"-Wno-packed-not-aligned",
+	"-Wno-restrict",
+	"-Wno-stringop-overflow",
+	"-Wno-stringop-truncation",
+}
+
+// readCompilationDatabase parses the compilation database from file, or from stdin if file is "-",
+// and removes the stripFlags from the compiler arguments.
+// The extractor binary needs the database on disk, so if it's read from stdin or changed,
+// it's saved to a temp dir. Returns the file that should be passed to the binary,
+// and the number of commands with stripped flags.
+func readCompilationDatabase(file string, stdin io.Reader, stripFlags []string) (
+	string, []compileCommand, int, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return "", nil, 0, err
+	}
+	data, stripped, err := stripCompilerFlags(data, stripFlags)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("failed to parse %v: %w", file, jsonErrorPos(data, err))
+	}
+	cmds, err := parseCompilationDatabase(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("failed to parse %v: %w", file, jsonErrorPos(data, err))
+	}
+	if file != "-" && stripped == 0 {
+		return file, cmds, 0, nil
+	}
+	file, err = saveTempDatabase(data)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return file, cmds, stripped, nil
+}
+
+// saveTempDatabase saves the database to a new temp dir, the caller needs to remove the dir.
+func saveTempDatabase(data []byte) (string, error) {
+	dir, err := os.MkdirTemp("", "syz-declextract")
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, "compile_commands.json")
+	if err := osutil.WriteFile(file, data); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return file, nil
+}
+
+// expandDatabases returns the database files from the comma-separated list of files and globs.
+func expandDatabases(list string) ([]string, error) {
+	var files []string
+	for _, pattern := range strings.Split(list, ",") {
+		if !strings.ContainsAny(pattern, "*?[") {
+			files = append(files, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no compilation databases match %v", pattern)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) > 1 && slices.Contains(files, "-") {
+		return nil, fmt.Errorf("- can't be used with other compilation databases")
+	}
+	return files, nil
+}
+
+// readCompilationDatabases is readCompilationDatabase for several databases (e.g. one per subdirectory).
+// The databases are merged into one in a temp dir, since the extractor binary accepts only one.
+// Entries for files that are already present in one of the preceding databases are dropped.
+func readCompilationDatabases(files []string, stdin io.Reader, stripFlags []string) (
+	string, []compileCommand, int, error) {
+	if len(files) == 1 {
+		return readCompilationDatabase(files[0], stdin, stripFlags)
+	}
+	var merged []map[string]json.RawMessage
+	owners := make(map[string]string)
+	stripped := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		data, n, err := stripCompilerFlags(data, stripFlags)
+		if err != nil {
+			return "", nil, 0, fmt.Errorf("failed to parse %v: %w", file, jsonErrorPos(data, err))
+		}
+		stripped += n
+		var entries []map[string]json.RawMessage
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return "", nil, 0, fmt.Errorf("failed to parse %v: %w", file, jsonErrorPos(data, err))
+		}
+		for _, entry := range entries {
+			var cmd compileCommand
+			json.Unmarshal(entry["file"], &cmd.File)
+			json.Unmarshal(entry["directory"], &cmd.Directory)
+			key := cmd.File
+			if !filepath.IsAbs(key) {
+				key = filepath.Join(cmd.Directory, key)
+			}
+			if owner, ok := owners[key]; ok && owner != file {
+				continue
+			}
+			owners[key] = file
+			merged = append(merged, entry)
+		}
+	}
+	data, err := json.MarshalIndent(merged, "", "\t")
+	if err != nil {
+		return "", nil, 0, err
+	}
+	cmds, err := parseCompilationDatabase(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, 0, err
+	}
+	file, err := saveTempDatabase(data)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return file, cmds, stripped, nil
+}
+
+// parseCompilationDatabase parses the database entries. Entries may specify either "arguments"
+// or a shell "command" string (gen_compile_commands.py emits the latter), the command is split into Arguments.
+func parseCompilationDatabase(r io.Reader) ([]compileCommand, error) {
+	var cmds []compileCommand
+	if err := json.NewDecoder(r).Decode(&cmds); err != nil {
+		return nil, err
+	}
+	for i := range cmds {
+		cmds[i].Arguments = cmds[i].args()
+	}
+	return cmds, nil
+}
+
+// splitCommand splits a shell command line into arguments. Quotes and backslashes are handled
+// as in the shell, other shell syntax (variables, redirections) doesn't appear in compile commands.
+func splitCommand(command string) []string {
+	var args []string
+	var arg []byte
+	inArg := false
+	var quote byte
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg = append(arg, c)
+			}
+		case c == '\\' && i+1 < len(command) && (quote == 0 || strings.IndexByte("\"\\$`", command[i+1]) != -1):
+			i++
+			arg = append(arg, command[i])
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg = append(arg, c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		default:
+			arg = append(arg, c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+// jsonErrorPos adds the position of the error in data to JSON syntax and type errors.
+// The position is the offending character for syntax errors and the end of the value for type errors.
+func jsonErrorPos(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte{'\n'}) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n') - 1
+	return fmt.Errorf("line %v, column %v: %w", line, col, err)
+}
+
+// validateCommands checks that the commands have the fields the extractor needs.
+// All problems are reported at once along with the index of the entry, so that they can be fixed in one go.
+func validateCommands(cmds []compileCommand) error {
+	var problems []string
+	for i, cmd := range cmds {
+		if cmd.File == "" {
+			problems = append(problems, fmt.Sprintf("entry %v: empty file", i))
+		}
+		if len(cmd.Arguments) == 0 {
+			problems = append(problems, fmt.Sprintf("entry %v (%v): empty arguments and command", i, cmd.File))
+		}
+		if cmd.Directory == "" {
+			problems = append(problems, fmt.Sprintf("entry %v (%v): empty directory", i, cmd.File))
+		} else if !osutil.IsExist(cmd.Directory) {
+			problems = append(problems, fmt.Sprintf("entry %v (%v): directory %v does not exist",
+				i, cmd.File, cmd.Directory))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid compilation database:\n%v", strings.Join(problems, "\n"))
+}
+
+// stripCompilerFlags removes the flags from "arguments" of the database entries.
+// Entries with a "command" string get the remaining arguments instead of the command.
+// Other entry fields are preserved, and the data is returned as is if nothing is removed.
+func stripCompilerFlags(data []byte, flags []string) ([]byte, int, error) {
+	if len(flags) == 0 {
+		return data, 0, nil
+	}
+	var entries []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, 0, err
+	}
+	stripped := 0
+	for _, entry := range entries {
+		var args []string
+		if entry["arguments"] != nil {
+			if err := json.Unmarshal(entry["arguments"], &args); err != nil {
+				return nil, 0, err
+			}
+		}
+		if len(args) == 0 && entry["command"] != nil {
+			var command string
+			if err := json.Unmarshal(entry["command"], &command); err != nil {
+				return nil, 0, err
+			}
+			args = splitCommand(command)
+		}
+		filtered := slices.DeleteFunc(slices.Clone(args), func(arg string) bool {
+			return isStrippedFlag(arg, flags)
+		})
+		if len(filtered) == len(args) {
+			continue
+		}
+		stripped++
+		data, err := json.Marshal(filtered)
+		if err != nil {
+			return nil, 0, err
+		}
+		entry["arguments"] = data
+		delete(entry, "command")
+	}
+	if stripped == 0 {
+		return data, 0, nil
+	}
+	data, err := json.MarshalIndent(entries, "", "\t")
+	return data, stripped, err
+}
+
+func isStrippedFlag(arg string, flags []string) bool {
+	for _, flag := range flags {
+		if prefix, ok := strings.CutSuffix(flag, "*"); ok && strings.HasPrefix(arg, prefix) || arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupCommands removes repeated compile commands for the same file (e.g. listed for several configs),
+// keeping the first occurrence. Commands with different arguments (or command strings) are all kept
+// since they can produce different descriptions, such files are returned as conflicting.
+func dedupCommands(cmds []compileCommand) ([]compileCommand, int, []string) {
+	var res []compileCommand
+	var conflicting []string
+	duplicates := 0
+	seen := make(map[string][][]string)
+	for _, cmd := range cmds {
+		prev := seen[cmd.File]
+		cmdArgs := cmd.args()
+		if slices.ContainsFunc(prev, func(args []string) bool { return slices.Equal(args, cmdArgs) }) {
+			duplicates++
+			continue
+		}
+		if len(prev) == 1 {
+			conflicting = append(conflicting, cmd.File)
+		}
+		seen[cmd.File] = append(prev, cmdArgs)
+		res = append(res, cmd)
+	}
+	return res, duplicates, conflicting
+}
+
+// filterCommands returns commands for files matching any of the filters. Filters are path prefixes
+// (e.g. "fs/" or "net/ipv4") or globs (e.g. "drivers/*/foo.c") matched against the file path
+// relative to kernelDir.
+func filterCommands(cmds []compileCommand, kernelDir string, filters []string) []compileCommand {
+	if len(filters) == 0 {
+		return cmds
+	}
+	var res []compileCommand
+	for _, cmd := range cmds {
+		file := commandFile(cmd, kernelDir)
+		if slices.ContainsFunc(filters, func(filter string) bool { return matchFilter(file, filter) }) {
+			res = append(res, cmd)
+		}
+	}
+	return res
+}
+
+// excludeFiles returns commands for files not matching any of the patterns and the number of removed commands.
+// Patterns are the same as for filterCommands, except that patterns without '/' are also matched
+// against the file name (e.g. "*.mod.c" matches files in all directories).
+func excludeFiles(cmds []compileCommand, kernelDir string, patterns []string) ([]compileCommand, int) {
+	var res []compileCommand
+	for _, cmd := range cmds {
+		file := commandFile(cmd, kernelDir)
+		if !slices.ContainsFunc(patterns, func(pattern string) bool {
+			return matchFilter(file, pattern) ||
+				!strings.Contains(pattern, "/") && matchFilter(path.Base(file), pattern)
+		}) {
+			res = append(res, cmd)
+		}
+	}
+	return res, len(cmds) - len(res)
+}
+
+// commandFile returns the file path of the command relative to kernelDir (if possible) with forward slashes.
+func commandFile(cmd compileCommand, kernelDir string) string {
+	file := cmd.File
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(cmd.Directory, file)
+	}
+	if rel, err := filepath.Rel(kernelDir, file); kernelDir != "" && err == nil {
+		file = rel
+	}
+	return filepath.ToSlash(file)
+}
+
+func matchFilter(file, filter string) bool {
+	if strings.ContainsAny(filter, "*?[") {
+		match, _ := filepath.Match(filter, file)
+		return match
+	}
+	filter = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(filter)), "/")
+	return file == filter || strings.HasPrefix(file, filter+"/")
+}
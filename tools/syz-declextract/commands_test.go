@@ -0,0 +1,398 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadCompilationDatabaseStdin(t *testing.T) {
+	const db = `[
+	{"arguments": ["cc", "-c", "a.c"], "directory": "/kernel", "file": "fs/a.c"},
+	{"arguments": ["cc", "-c", "b.c"], "directory": "/kernel", "file": "fs/b.c"}
+]`
+	want := []compileCommand{
+		{Arguments: []string{"cc", "-c", "a.c"}, Directory: "/kernel", File: "fs/a.c"},
+		{Arguments: []string{"cc", "-c", "b.c"}, Directory: "/kernel", File: "fs/b.c"},
+	}
+	file, cmds, _, err := readCompilationDatabase("-", strings.NewReader(db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	if !reflect.DeepEqual(cmds, want) {
+		t.Fatalf("got commands %+v, want %+v", cmds, want)
+	}
+	// The binary gets the database from disk.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != db {
+		t.Fatalf("saved database differs:\n%s", data)
+	}
+	var dispatched []compileCommand
+	extractAll(cmds, 1, func(cmd compileCommand) output {
+		return output{file: cmd.File}
+	}, func(out output) {
+		dispatched = append(dispatched, compileCommand{File: out.file})
+	}, nil, 0)
+	if len(dispatched) != len(want) || dispatched[0].File != "fs/a.c" || dispatched[1].File != "fs/b.c" {
+		t.Fatalf("dispatched %+v", dispatched)
+	}
+	if _, _, _, err := readCompilationDatabase("-", strings.NewReader("{"), nil); err == nil {
+		t.Fatalf("no error for malformed database")
+	}
+}
+
+func TestDedupCommands(t *testing.T) {
+	cmds := []compileCommand{
+		{Arguments: []string{"cc", "a.c"}, File: "a.c"},
+		{Arguments: []string{"cc", "b.c"}, File: "b.c"},
+		{Arguments: []string{"cc", "a.c"}, File: "a.c"},
+		{Arguments: []string{"cc", "-DFOO", "b.c"}, File: "b.c"},
+		{Arguments: []string{"cc", "b.c"}, File: "b.c"},
+		{Arguments: []string{"cc", "-DBAR", "b.c"}, File: "b.c"},
+		{Arguments: []string{"cc", "c.c"}, File: "c.c"},
+	}
+	res, duplicates, conflicting := dedupCommands(cmds)
+	want := []compileCommand{cmds[0], cmds[1], cmds[3], cmds[5], cmds[6]}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got commands %+v, want %+v", res, want)
+	}
+	if duplicates != 2 {
+		t.Errorf("got %v duplicates, want 2", duplicates)
+	}
+	if !reflect.DeepEqual(conflicting, []string{"b.c"}) {
+		t.Errorf("got conflicting %v, want [b.c]", conflicting)
+	}
+	// Entries of kernel databases have only command strings.
+	cmds = []compileCommand{
+		{Command: "cc -c a.c", File: "a.c"},
+		{Command: "cc  -c a.c", File: "a.c"},
+		{Command: "cc -DFOO -c a.c", File: "a.c"},
+		{Arguments: []string{"cc", "-DFOO", "-c", "a.c"}, File: "a.c"},
+	}
+	res, duplicates, conflicting = dedupCommands(cmds)
+	if want := []compileCommand{cmds[0], cmds[2]}; !reflect.DeepEqual(res, want) {
+		t.Errorf("got commands %+v, want %+v", res, want)
+	}
+	if duplicates != 2 {
+		t.Errorf("got %v duplicates, want 2", duplicates)
+	}
+	if !reflect.DeepEqual(conflicting, []string{"a.c"}) {
+		t.Errorf("got conflicting %v, want [a.c]", conflicting)
+	}
+}
+
+func TestStripCompilerFlags(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "compile_commands.json")
+	writeFile(t, db, `[
+	{"arguments": ["gcc", "-c", "-fconserve-stack", "-mindirect-branch=thunk-extern", "a.c"],
+		"directory": "/kernel", "file": "a.c", "output": "a.o", "extra": 1},
+	{"arguments": ["gcc", "-c", "-O2", "b.c"], "directory": "/kernel", "file": "b.c"},
+	{"arguments": ["gcc", "-c", "-fplugin-arg-structleak_plugin-byref", "c.c"], "directory": "/kernel", "file": "c.c"}
+]`)
+	file, cmds, stripped, err := readCompilationDatabase(db, nil, defaultStripFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file == db {
+		t.Fatalf("changed database is not saved to a temp file")
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	if stripped != 2 {
+		t.Errorf("got %v commands with stripped flags, want 2", stripped)
+	}
+	want := []compileCommand{
+		{Arguments: []string{"gcc", "-c", "a.c"}, Directory: "/kernel", File: "a.c", Output: "a.o"},
+		{Arguments: []string{"gcc", "-c", "-O2", "b.c"}, Directory: "/kernel", File: "b.c"},
+		{Arguments: []string{"gcc", "-c", "c.c"}, Directory: "/kernel", File: "c.c"},
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("got commands %+v, want %+v", cmds, want)
+	}
+	// The extractor gets the same commands, other fields are preserved.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := parseCompilationDatabase(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved commands %+v, want %+v", saved, want)
+	}
+	if !strings.Contains(string(data), `"extra": 1`) {
+		t.Errorf("lost entry fields:\n%s", data)
+	}
+
+	// Nothing to strip, the database is used as is.
+	file, _, stripped, err = readCompilationDatabase(db, nil, []string{"-mno-red-zone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != db || stripped != 0 {
+		t.Errorf("got file %v with %v stripped commands, want the original database", file, stripped)
+	}
+}
+
+func TestStripCompilerFlagsCommand(t *testing.T) {
+	const db = `[
+	{"command": "gcc -c -fconserve-stack -DX='\"a b\"' a.c", "directory": "/kernel", "file": "a.c"},
+	{"command": "gcc -c -O2 b.c", "directory": "/kernel", "file": "b.c"}
+]`
+	file, cmds, stripped, err := readCompilationDatabase("-", strings.NewReader(db), defaultStripFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	if stripped != 1 {
+		t.Errorf("got %v commands with stripped flags, want 1", stripped)
+	}
+	want := []compileCommand{
+		{Arguments: []string{"gcc", "-c", `-DX="a b"`, "a.c"}, Directory: "/kernel", File: "a.c"},
+		{Arguments: []string{"gcc", "-c", "-O2", "b.c"}, Command: "gcc -c -O2 b.c", Directory: "/kernel", File: "b.c"},
+	}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Errorf("got commands %+v, want %+v", cmds, want)
+	}
+	// The extractor must not see the stripped flags in the command either.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "-fconserve-stack") {
+		t.Errorf("stripped flag is left in the saved database:\n%s", data)
+	}
+	saved, err := parseCompilationDatabase(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, want) {
+		t.Errorf("saved commands %+v, want %+v", saved, want)
+	}
+}
+
+func TestFilterCommands(t *testing.T) {
+	cmds := []compileCommand{
+		{Directory: "/kernel", File: "fs/open.c"},
+		{Directory: "/kernel", File: "/kernel/fs/ext4/inode.c"},
+		{Directory: "/kernel/build", File: "../fs/read_write.c"},
+		{Directory: "/kernel", File: "fsx/foo.c"},
+		{Directory: "/kernel", File: "net/socket.c"},
+		{Directory: "/kernel", File: "drivers/tty/tty_io.c"},
+		{Directory: "/kernel", File: "drivers/block/loop.c"},
+	}
+	files := func(cmds []compileCommand) []string {
+		var res []string
+		for _, cmd := range cmds {
+			res = append(res, cmd.File)
+		}
+		return res
+	}
+	for _, test := range []struct {
+		filters []string
+		want    []string
+	}{
+		{
+			filters: []string{"fs/"},
+			want:    []string{"fs/open.c", "/kernel/fs/ext4/inode.c", "../fs/read_write.c"},
+		},
+		{
+			filters: []string{"fs/ext4", "net"},
+			want:    []string{"/kernel/fs/ext4/inode.c", "net/socket.c"},
+		},
+		{
+			filters: []string{"drivers/*/loop.c", "fs/*.c"},
+			want:    []string{"fs/open.c", "../fs/read_write.c", "drivers/block/loop.c"},
+		},
+		{
+			filters: nil,
+			want:    files(cmds),
+		},
+	} {
+		got := files(filterCommands(cmds, "/kernel", test.filters))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("filters %q: got %q, want %q", test.filters, got, test.want)
+		}
+	}
+}
+
+func TestExcludeFiles(t *testing.T) {
+	cmds := []compileCommand{
+		{Directory: "/kernel", File: "fs/open.c"},
+		{Directory: "/kernel", File: "drivers/tty/serial.mod.c"},
+		{Directory: "/kernel", File: "/kernel/scripts/mod/modpost.c"},
+		{Directory: "/kernel/build", File: "../tools/lib/bpf.c"},
+		{Directory: "/kernel", File: "net/vendor/lib.c"},
+		{Directory: "/kernel", File: "net/socket.c"},
+	}
+	var files []string
+	for _, cmd := range selectCommands(cmds, "/kernel", "", strings.Join(defaultExcludeFiles, ","), "") {
+		files = append(files, cmd.File)
+	}
+	if want := []string{"fs/open.c", "net/vendor/lib.c", "net/socket.c"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %q, want %q", files, want)
+	}
+	res, skipped := excludeFiles(cmds, "/kernel", []string{"net/vendor", "*.mod.c", "fs/*.c"})
+	if len(res) != 3 || skipped != 3 {
+		t.Errorf("got %v commands, %v skipped, want 3 and 3", len(res), skipped)
+	}
+	if res, skipped := excludeFiles(cmds, "/kernel", nil); len(res) != len(cmds) || skipped != 0 {
+		t.Errorf("got %v commands, %v skipped without patterns, want all", len(res), skipped)
+	}
+}
+
+func TestValidateCommands(t *testing.T) {
+	dir := t.TempDir()
+	cmds := []compileCommand{
+		{Arguments: []string{"cc", "a.c"}, Directory: dir, File: "a.c"},
+		{Arguments: []string{"cc", "b.c"}, Directory: dir},
+		{Directory: filepath.Join(dir, "missing"), File: "c.c"},
+		{Arguments: []string{"cc", "d.c"}, File: "d.c"},
+	}
+	err := validateCommands(cmds[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validateCommands(cmds)
+	if err == nil {
+		t.Fatal("no error for invalid commands")
+	}
+	want := fmt.Sprintf(`invalid compilation database:
+entry 1: empty file
+entry 2 (c.c): empty arguments and command
+entry 2 (c.c): directory %v does not exist
+entry 3 (d.c): empty directory`, filepath.Join(dir, "missing"))
+	if err.Error() != want {
+		t.Fatalf("got error:\n%v\nwant:\n%v", err, want)
+	}
+}
+
+func TestReadCompilationDatabaseCommand(t *testing.T) {
+	// Databases generated by scripts/clang-tools/gen_compile_commands.py have command strings instead of arguments.
+	dir := t.TempDir()
+	db := fmt.Sprintf(`[
+	{"command": "gcc -DKBUILD_MODNAME='\"a\"' -c -o fs/a.o fs/a.c", "directory": %[1]q, "file": "fs/a.c"},
+	{"command": "gcc -D'STR=\"x y\"' -c  b.c", "arguments": [], "directory": %[1]q, "file": "b.c"}
+]`, dir)
+	file, cmds, _, err := readCompilationDatabase("-", strings.NewReader(db), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	want := [][]string{
+		{"gcc", `-DKBUILD_MODNAME="a"`, "-c", "-o", "fs/a.o", "fs/a.c"},
+		{"gcc", `-DSTR="x y"`, "-c", "b.c"},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("got %v commands, want %v", len(cmds), len(want))
+	}
+	for i, cmd := range cmds {
+		if !slices.Equal(cmd.Arguments, want[i]) {
+			t.Errorf("command %v: got arguments %q, want %q", i, cmd.Arguments, want[i])
+		}
+	}
+	if err := validateCommands(cmds); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	for command, want := range map[string][]string{
+		"":                           nil,
+		"  cc  -c\ta.c ":             {"cc", "-c", "a.c"},
+		`cc -DX='a "b"' -DY="a 'b'"`: {"cc", `-DX=a "b"`, `-DY=a 'b'`},
+		`cc -DX=\"a\ b\" "\$\x" ''`:  {"cc", `-DX="a b"`, `$\x`, ""},
+	} {
+		if got := splitCommand(command); !slices.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestReadCompilationDatabaseErrorPos(t *testing.T) {
+	tests := []struct {
+		db  string
+		pos string
+	}{
+		{"[\n\t{\"file\": \"a.c\"},\n\t{\"file\": \"b.c\",}\n]", "line 3, column 17"},
+		{"[\n\t{\"file\": \"a.c\", \"arguments\": \"cc a.c\"}\n]", "line 2, column 38"},
+	}
+	for _, test := range tests {
+		_, _, _, err := readCompilationDatabase("-", strings.NewReader(test.db), nil)
+		if err == nil || !strings.Contains(err.Error(), test.pos) {
+			t.Errorf("got error %v, want it at %v", err, test.pos)
+		}
+	}
+}
+
+func TestReadCompilationDatabases(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "fs", "compile_commands.json"), `[
+	{"arguments": ["cc", "-c", "a.c"], "directory": "/kernel", "file": "fs/a.c"},
+	{"arguments": ["cc", "-c", "-DX", "a.c"], "directory": "/kernel", "file": "fs/a.c"},
+	{"arguments": ["cc", "-c", "b.c"], "directory": "/kernel", "file": "/kernel/fs/b.c"}
+]`)
+	writeFile(t, filepath.Join(dir, "mm", "compile_commands.json"), `[
+	{"arguments": ["cc", "-c", "-mrecord-mcount", "c.c"], "directory": "/kernel", "file": "mm/c.c"},
+	{"arguments": ["cc", "-c", "-DY", "b.c"], "directory": "/kernel", "file": "fs/b.c"}
+]`)
+	files, err := expandDatabases(filepath.Join(dir, "*", "compile_commands.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got databases %v", files)
+	}
+	file, cmds, stripped, err := readCompilationDatabases(files, nil, defaultStripFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+	// Variants from the same database are kept, fs/b.c from the second database is dropped.
+	want := []compileCommand{
+		{Arguments: []string{"cc", "-c", "a.c"}, Directory: "/kernel", File: "fs/a.c"},
+		{Arguments: []string{"cc", "-c", "-DX", "a.c"}, Directory: "/kernel", File: "fs/a.c"},
+		{Arguments: []string{"cc", "-c", "b.c"}, Directory: "/kernel", File: "/kernel/fs/b.c"},
+		{Arguments: []string{"cc", "-c", "c.c"}, Directory: "/kernel", File: "mm/c.c"},
+	}
+	if !reflect.DeepEqual(cmds, want) || stripped != 1 {
+		t.Fatalf("got %v stripped, commands %+v", stripped, cmds)
+	}
+	// The binary gets all commands from the merged database.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := parseCompilationDatabase(strings.NewReader(string(data)))
+	if err != nil || !reflect.DeepEqual(saved, want) {
+		t.Fatalf("saved database %+v: %v", saved, err)
+	}
+	var dispatched []string
+	extractAll(cmds, 2, func(cmd compileCommand) output {
+		return output{file: cmd.File}
+	}, func(out output) {
+		dispatched = append(dispatched, out.file)
+	}, nil, 0)
+	slices.Sort(dispatched)
+	if want := []string{"/kernel/fs/b.c", "fs/a.c", "fs/a.c", "mm/c.c"}; !slices.Equal(dispatched, want) {
+		t.Fatalf("dispatched %v, want %v", dispatched, want)
+	}
+	if _, err := expandDatabases("-," + files[0]); err == nil {
+		t.Fatalf("no error for stdin with other databases")
+	}
+	if _, err := expandDatabases(filepath.Join(dir, "*.nothing")); err == nil {
+		t.Fatalf("no error for a glob without matches")
+	}
+}
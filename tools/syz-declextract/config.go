@@ -0,0 +1,137 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configDeps returns kernel configs the code at the file:line location (relative to kernelDir) depends on:
+// the config the file is built under according to obj-$(CONFIG_FOO) in its Makefile,
+// and the configs of the enclosing #ifdef CONFIG_FOO and #if IS_ENABLED(CONFIG_FOO) blocks.
+// Returns false if the dependencies can't be determined, e.g. the location is in an #else branch
+// or under a more complex condition.
+func configDeps(kernelDir, location string) ([]string, bool) {
+	file, lineStr, ok := cutLast(location, ":")
+	line, err := strconv.Atoi(lineStr)
+	if !ok || err != nil {
+		return nil, false
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(kernelDir, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, false
+	}
+	configs, ok := conditionConfigs(string(data), line)
+	if !ok {
+		return nil, false
+	}
+	if config := makefileConfig(file); config != "" {
+		configs = append(configs, config)
+	}
+	slices.Sort(configs)
+	return slices.Compact(configs), true
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	pos := strings.LastIndex(s, sep)
+	if pos == -1 {
+		return s, "", false
+	}
+	return s[:pos], s[pos+len(sep):], true
+}
+
+// preprocessorCond is a conditional block that encloses a line.
+type preprocessorCond struct {
+	config  string // the block is compiled only if the config is enabled
+	unknown bool   // the block depends on configs in a way we don't understand
+}
+
+var (
+	directiveRe  = regexp.MustCompile(`^\s*#\s*(ifdef|ifndef|if|elif|else|endif)\b\s*(.*)$`)
+	configCondRe = regexp.MustCompile(
+		`^(?:defined\s*\(?\s*(CONFIG_\w+)\s*\)?|IS_(?:ENABLED|BUILTIN|REACHABLE)\((CONFIG_\w+)\)|(CONFIG_\w+))$`)
+)
+
+// conditionConfigs returns configs of the conditional blocks enclosing the line (1-based) of the source.
+func conditionConfigs(source string, line int) ([]string, bool) {
+	var stack []preprocessorCond
+	for i, text := range strings.Split(source, "\n") {
+		if i+1 >= line {
+			break
+		}
+		match := directiveRe.FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		expr, _, _ := strings.Cut(match[2], "/*")
+		expr, _, _ = strings.Cut(expr, "//")
+		expr = strings.TrimSpace(expr)
+		switch match[1] {
+		case "ifdef":
+			stack = append(stack, parseCond("defined("+expr+")"))
+		case "ifndef":
+			stack = append(stack, preprocessorCond{unknown: strings.HasPrefix(expr, "CONFIG_")})
+		case "if":
+			stack = append(stack, parseCond(expr))
+		case "elif", "else":
+			if len(stack) == 0 {
+				return nil, false
+			}
+			// The branch also depends on the negation of the previous conditions.
+			top := &stack[len(stack)-1]
+			top.unknown = top.unknown || top.config != "" || strings.Contains(expr, "CONFIG_")
+			top.config = ""
+		case "endif":
+			if len(stack) == 0 {
+				return nil, false
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	var configs []string
+	for _, cond := range stack {
+		if cond.unknown {
+			return nil, false
+		}
+		if cond.config != "" {
+			configs = append(configs, cond.config)
+		}
+	}
+	return configs, true
+}
+
+func parseCond(expr string) preprocessorCond {
+	if match := configCondRe.FindStringSubmatch(expr); match != nil {
+		return preprocessorCond{config: match[1] + match[2] + match[3]}
+	}
+	// Conditions that don't involve configs (e.g. header guards) don't matter.
+	return preprocessorCond{unknown: strings.Contains(expr, "CONFIG_")}
+}
+
+var makefileObjRe = regexp.MustCompile(`^obj-\$\((CONFIG_\w+)\)\s*[+:]?=(.*)$`)
+
+// makefileConfig returns the config the file is built under according to the Makefile in the same directory,
+// or "" if it's not known.
+func makefileConfig(file string) string {
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(file), "Makefile"))
+	if err != nil {
+		return ""
+	}
+	obj := strings.TrimSuffix(filepath.Base(file), ".c") + ".o"
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\\\n", " "), "\n") {
+		match := makefileObjRe.FindStringSubmatch(line)
+		if match != nil && slices.Contains(strings.Fields(match[2]), obj) {
+			return match[1]
+		}
+	}
+	return ""
+}
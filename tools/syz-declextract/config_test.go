@@ -0,0 +1,85 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestConfigDeps(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "fs", "Makefile"), `
+obj-y := open.o read_write.o
+obj-$(CONFIG_FHANDLE) += fhandle.o \
+	other.o
+`)
+	source := `#include <linux/syscalls.h>
+#ifndef _FOO_H
+SYSCALL_DEFINE0(plain)
+#ifdef CONFIG_COMPAT /* comment */
+SYSCALL_DEFINE0(compat)
+#if IS_ENABLED(CONFIG_FOO) && defined(CONFIG_BAR)
+SYSCALL_DEFINE0(complex)
+#elif defined(CONFIG_BAZ)
+SYSCALL_DEFINE0(elif)
+#endif
+#if defined(CONFIG_FOO)
+SYSCALL_DEFINE0(nested)
+#else
+SYSCALL_DEFINE0(else)
+#endif
+#endif
+#if 1
+SYSCALL_DEFINE0(after)
+#endif
+#ifndef CONFIG_MMU
+SYSCALL_DEFINE0(nommu)
+#endif
+#endif
+`
+	lineOf := func(name string) int {
+		for i, line := range strings.Split(source, "\n") {
+			if strings.Contains(line, "("+name+")") {
+				return i + 1
+			}
+		}
+		t.Fatalf("no %v", name)
+		return 0
+	}
+	writeFile(t, filepath.Join(dir, "fs", "fhandle.c"), source)
+	writeFile(t, filepath.Join(dir, "fs", "open.c"), source)
+	tests := []struct {
+		file    string
+		syscall string
+		configs []string
+		ok      bool
+	}{
+		{"fs/fhandle.c", "plain", []string{"CONFIG_FHANDLE"}, true},
+		{"fs/fhandle.c", "compat", []string{"CONFIG_COMPAT", "CONFIG_FHANDLE"}, true},
+		{"fs/fhandle.c", "nested", []string{"CONFIG_COMPAT", "CONFIG_FHANDLE", "CONFIG_FOO"}, true},
+		{"fs/open.c", "compat", []string{"CONFIG_COMPAT"}, true},
+		{"fs/open.c", "plain", nil, true},
+		{"fs/open.c", "after", nil, true},
+		{"fs/open.c", "complex", nil, false},
+		{"fs/open.c", "elif", nil, false},
+		{"fs/open.c", "else", nil, false},
+		{"fs/open.c", "nommu", nil, false},
+	}
+	for _, test := range tests {
+		location := test.file + ":" + fmt.Sprint(lineOf(test.syscall))
+		configs, ok := configDeps(dir, location)
+		if ok != test.ok || !cmp.Equal(configs, test.configs, cmpopts.EquateEmpty()) {
+			t.Errorf("%v (%v): got %v/%v, want %v/%v", test.syscall, location, configs, ok, test.configs, test.ok)
+		}
+	}
+	if _, ok := configDeps(dir, "fs/missing.c:1"); ok {
+		t.Errorf("got dependencies for a missing file")
+	}
+}
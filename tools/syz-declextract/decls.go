@@ -0,0 +1,56 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// The extractor may emit resource and type declarations (e.g. "resource fd_foo[fd]" or "type foo int32")
+// along with syscalls, and flags definitions (e.g. "o_flags = O_RDONLY, O_WRONLY") are added for arguments.
+// They are shared across files, so they are deduplicated by name and emitted once at the beginning of the output.
+
+type declaration struct {
+	text string
+	file string
+}
+
+type declarations map[string]declaration
+
+// declarationName returns the name of the resource/type/flags declared on the line.
+func declarationName(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "=" {
+		return fields[0], true
+	}
+	if len(fields) < 2 || fields[0] != "resource" && fields[0] != "type" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(fields[1], "[")
+	return name, true
+}
+
+// add records the declaration, it's an error to declare the same name differently.
+func (decls declarations) add(name, line, file string) error {
+	line = strings.TrimSpace(line)
+	if prev, ok := decls[name]; ok {
+		if prev.text != line {
+			return fmt.Errorf("conflicting declarations of %v: %q (in %v) and %q", name, prev.text, prev.file, line)
+		}
+		return nil
+	}
+	decls[name] = declaration{text: line, file: file}
+	return nil
+}
+
+func (decls declarations) sorted() []string {
+	var res []string
+	for _, decl := range decls {
+		res = append(res, decl.text)
+	}
+	slices.Sort(res)
+	return res
+}
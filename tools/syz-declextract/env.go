@@ -0,0 +1,46 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envFlag collects environment variables for the extractor processes from repeated -env flags.
+// A value is either KEY=VAL, or a file with KEY=VAL lines (empty lines and # comments are ignored).
+type envFlag []string
+
+func (env *envFlag) String() string {
+	return strings.Join(*env, ",")
+}
+
+func (env *envFlag) Set(value string) error {
+	if strings.Contains(value, "=") {
+		return env.add(value)
+	}
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := env.add(line); err != nil {
+			return fmt.Errorf("%v: %w", value, err)
+		}
+	}
+	return nil
+}
+
+func (env *envFlag) add(v string) error {
+	if key, _, _ := strings.Cut(v, "="); key == "" || strings.ContainsAny(key, " \t") {
+		return fmt.Errorf("bad environment variable %q, want KEY=VAL", v)
+	}
+	*env = append(*env, v)
+	return nil
+}
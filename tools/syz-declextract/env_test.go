@@ -0,0 +1,43 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnvFlag(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "env")
+	writeFile(t, file, "# toolchain\nCC=clang\n\nSYSROOT=/sysroot\n")
+	var env envFlag
+	for _, value := range []string{"FOO=bar", file, "EMPTY="} {
+		if err := env.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := (envFlag{"FOO=bar", "CC=clang", "SYSROOT=/sysroot", "EMPTY="}); !reflect.DeepEqual(env, want) {
+		t.Fatalf("got %q, want %q", env, want)
+	}
+	for _, bad := range []string{"=bar", "A B=c", filepath.Join(t.TempDir(), "missing")} {
+		if err := env.Set(bad); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func TestExtractorEnv(t *testing.T) {
+	t.Setenv("SYZ_INHERITED", "inherited")
+	t.Setenv("SYZ_OVERRIDDEN", "old")
+	ex := &extractor{
+		binary:  fakeExtractor(t, `echo "$SYZ_INHERITED $SYZ_OVERRIDDEN $SYZ_NEW"`),
+		timeout: time.Minute,
+		env:     []string{"SYZ_OVERRIDDEN=new", "SYZ_NEW=added"},
+	}
+	if out := ex.extract("a.c"); out.stdout != "inherited new added\n" || out.stderr != "" {
+		t.Fatalf("got output %q, errors %q", out.stdout, out.stderr)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Flag constants are #define's with a common prefix in kernel headers, e.g. O_RDONLY, O_WRONLY, ... for open.
+// Integer arguments of extracted syscalls are heuristically associated with such groups by name,
+// and are emitted as flags[...] instead of plain integers.
+
+type flagGroup struct {
+	file   string
+	consts []string
+}
+
+// flagGroups maps constant name prefix (e.g. "O_") to the group.
+type flagGroups map[string]*flagGroup
+
+var (
+	flagDefineRe = regexp.MustCompile(`^#\s*define\s+([A-Z][A-Z0-9]*_[A-Z0-9_]+)\s+(.*)$`)
+	flagValueRe  = regexp.MustCompile(`^\(?\s*(0[xX][0-9a-fA-F]+|[0-9]+|1\s*<<\s*[0-9]+)[uUlL]*\s*\)?$`)
+)
+
+// readFlagHeaders parses flag groups from headers matching the comma-separated list of globs.
+func readFlagHeaders(patterns string) (flagGroups, error) {
+	groups := make(flagGroups)
+	for _, pattern := range strings.Split(patterns, ",") {
+		files, err := filepath.Glob(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no headers match %v", pattern)
+		}
+		for _, file := range files {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			groups.parse(f, file)
+			f.Close()
+		}
+	}
+	for prefix, group := range groups {
+		if len(group.consts) < 2 {
+			delete(groups, prefix) // a single constant is not a flag set
+		}
+	}
+	return groups, nil
+}
+
+func (groups flagGroups) parse(r io.Reader, file string) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		match := flagDefineRe.FindStringSubmatch(strings.TrimSpace(s.Text()))
+		if match == nil {
+			continue
+		}
+		value, _, _ := strings.Cut(match[2], "/*")
+		if !flagValueRe.MatchString(strings.TrimSpace(value)) {
+			continue
+		}
+		name := match[1]
+		prefix := name[:strings.IndexByte(name, '_')+1]
+		group := groups[prefix]
+		if group == nil {
+			group = &flagGroup{file: file}
+			groups[prefix] = group
+		}
+		if !slices.Contains(group.consts, name) {
+			group.consts = append(group.consts, name)
+		}
+	}
+}
+
+// shortFlagPrefixes lists syscalls that use flag groups with prefixes that are too short
+// to be matched against syscall names (S_ would match socket, sendto, setxattr, etc).
+var shortFlagPrefixes = map[string][]string{
+	"O_":  {"open", "openat", "openat2"},
+	"MS_": {"mount"},
+}
+
+// match returns the prefix of the group for the argument of the syscall, or "" if there is no
+// unambiguous match. A group matches if its lower-case prefix is the argument name (e.g. PROT_ for prot),
+// or if the argument looks like flags and the syscall name starts with the prefix (e.g. MOUNT_ for mount).
+// Prefixes shorter than 3 letters match only the syscalls listed in shortFlagPrefixes (e.g. O_ for open).
+// The longest matching prefix wins.
+func (groups flagGroups) match(syscall, arg string) string {
+	best, bestLen, ambiguous := "", 0, false
+	for prefix := range groups {
+		name := strings.ToLower(strings.TrimSuffix(prefix, "_"))
+		score := 0
+		switch {
+		case arg == name:
+			score = 1000 // exact argument name match always wins
+		case strings.Contains(arg, "flag") && matchSyscallPrefix(syscall, name, prefix):
+			score = len(name)
+		default:
+			continue
+		}
+		if score > bestLen {
+			best, bestLen, ambiguous = prefix, score, false
+		} else if score == bestLen {
+			ambiguous = true
+		}
+	}
+	if ambiguous {
+		return ""
+	}
+	return best
+}
+
+func matchSyscallPrefix(syscall, name, prefix string) bool {
+	if len(name) < 3 {
+		return slices.Contains(shortFlagPrefixes[prefix], syscall)
+	}
+	return strings.HasPrefix(syscall, name)
+}
+
+// apply replaces types of integer arguments associated with flag groups with flags[...],
+// and returns prefixes of the used groups.
+func (groups flagGroups) apply(desc string) (string, []string) {
+	if len(groups) == 0 {
+		return desc, nil
+	}
+	syscall := renameKey(desc)
+	_, args := parseDescription(desc)
+	var used []string
+	for _, arg := range args {
+		if arg.Type != "intptr" {
+			continue
+		}
+		prefix := groups.match(syscall, arg.Name)
+		if prefix == "" {
+			continue
+		}
+		for _, sep := range []string{"(", ", "} {
+			old := sep + arg.Name + " intptr"
+			if strings.Contains(desc, old) {
+				desc = strings.Replace(desc, old, sep+arg.Name+" flags["+flagsName(prefix)+"]", 1)
+				used = append(used, prefix)
+				break
+			}
+		}
+	}
+	return desc, used
+}
+
+// flagsName returns the name of the flags definition for the group, e.g. o_flags for O_.
+func flagsName(prefix string) string {
+	return strings.ToLower(prefix) + "flags"
+}
+
+func (groups flagGroups) decl(prefix string) string {
+	return flagsName(prefix) + " = " + strings.Join(groups[prefix].consts, ", ")
+}
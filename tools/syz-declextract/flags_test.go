@@ -0,0 +1,152 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testFlagsHeader = `
+#ifndef _TEST_FCNTL_H
+#define _TEST_FCNTL_H
+#define O_RDONLY	00000000
+#define O_WRONLY	00000001
+#define O_CREAT		0x40U /* create */
+#define O_CLOEXEC	(1 << 19)
+#define O_ACCMODE	(O_RDONLY | O_WRONLY)
+#define PROT_READ	0x1
+#define PROT_WRITE	0x2
+#define MAP_SHARED	0x01
+#define mmap_lower	0x1
+#endif
+`
+
+func TestReadFlagHeaders(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "fcntl.h"), testFlagsHeader)
+	groups, err := readFlagHeaders(filepath.Join(dir, "*.h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string)
+	for prefix, group := range groups {
+		got[prefix] = group.consts
+	}
+	want := map[string][]string{
+		"O_":    {"O_RDONLY", "O_WRONLY", "O_CREAT", "O_CLOEXEC"},
+		"PROT_": {"PROT_READ", "PROT_WRITE"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := readFlagHeaders(filepath.Join(dir, "*.nothing")); err == nil {
+		t.Fatal("no error for a pattern without matches")
+	}
+}
+
+func TestFlagGroupsMatch(t *testing.T) {
+	groups := flagGroups{
+		"O_":       {consts: []string{"O_RDONLY", "O_WRONLY"}},
+		"OPEN_":    {consts: []string{"OPEN_A", "OPEN_B"}},
+		"PROT_":    {consts: []string{"PROT_READ", "PROT_WRITE"}},
+		"MOUNT_":   {consts: []string{"MOUNT_A", "MOUNT_B"}},
+		"MOUNTX_":  {consts: []string{"MOUNTX_A", "MOUNTX_B"}},
+		"MODE_":    {consts: []string{"MODE_A", "MODE_B"}},
+		"MODEX_":   {consts: []string{"MODEX_A", "MODEX_B"}},
+		"UNUSED_":  {consts: []string{"UNUSED_A", "UNUSED_B"}},
+		"MOUNTXY_": {consts: []string{"MOUNTXY_A", "MOUNTXY_B"}},
+		"S_":       {consts: []string{"S_IFREG", "S_IFDIR"}},
+		"MS_":      {consts: []string{"MS_RDONLY", "MS_NOSUID"}},
+	}
+	tests := []struct {
+		syscall string
+		arg     string
+		want    string
+	}{
+		{"open", "flags", "OPEN_"}, // the longest prefix wins
+		{"openat", "flags", "OPEN_"},
+		{"openat", "mode", "MODE_"}, // exact argument name
+		{"mmap", "prot", "PROT_"},   // exact argument name
+		{"mmap", "flags", ""},       // no group
+		{"open", "filename", ""},    // doesn't look like flags
+		{"mountxy", "flags", "MOUNTXY_"},
+		{"read", "count", ""},
+		{"openat", "oflags", "OPEN_"},
+		{"sendto", "flags", ""}, // S_ is too short to match syscalls other than the listed ones
+		{"socket", "flags", ""},
+		{"setxattr", "flags", ""},
+		{"mount", "flags", "MOUNT_"},
+		{"ms_foo", "flags", ""},
+	}
+	for _, test := range tests {
+		if got := groups.match(test.syscall, test.arg); got != test.want {
+			t.Errorf("%v(%v): got %q, want %q", test.syscall, test.arg, got, test.want)
+		}
+	}
+	// Equally good matches are ambiguous, the raw integer type is used.
+	groups = flagGroups{
+		"OPEN_": {consts: []string{"OPEN_A", "OPEN_B"}},
+		"open_": {consts: []string{"open_a", "open_b"}},
+	}
+	if got := groups.match("open", "flags"); got != "" {
+		t.Errorf("ambiguous match: got %q", got)
+	}
+	// Short prefixes match the listed syscalls.
+	groups = flagGroups{
+		"O_":  {consts: []string{"O_RDONLY", "O_WRONLY"}},
+		"MS_": {consts: []string{"MS_RDONLY", "MS_NOSUID"}},
+	}
+	for syscall, want := range map[string]string{"open": "O_", "openat": "O_", "mount": "MS_", "oops": ""} {
+		if got := groups.match(syscall, "flags"); got != want {
+			t.Errorf("%v(flags): got %q, want %q", syscall, got, want)
+		}
+	}
+}
+
+func TestResultsFlags(t *testing.T) {
+	dir := t.TempDir()
+	header := filepath.Join(dir, "fcntl.h")
+	writeFile(t, header, testFlagsHeader)
+	groups, err := readFlagHeaders(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &results{
+		syscallNames: map[string][]string{"open": {"open"}, "mmap": {"mmap"}, "close": {"close"}},
+		flags:        groups,
+		decls:        make(declarations),
+		archOut:      make(map[string][]string),
+		origins:      make(map[string]string),
+	}
+	res.add(output{file: "fs/open.c", stdout: "open$auto(filename intptr, flags intptr, mode intptr) (automatic)\n"})
+	res.add(output{file: "mm/mmap.c", stdout: "mmap$auto(addr intptr, len intptr, prot intptr, " +
+		"flags intptr, fd intptr, off intptr) (automatic)\n"})
+	res.add(output{file: "fs/open.c", stdout: "close$auto(fd intptr) (automatic)\n"})
+	if len(res.failed) != 0 {
+		t.Fatalf("unexpected errors: %+v", res.failed)
+	}
+	got := string(formatOutput(res.decls.sorted(), res.allOut))
+	want := `# Code generated by syz-declextract. DO NOT EDIT.
+o_flags = O_RDONLY, O_WRONLY, O_CREAT, O_CLOEXEC
+prot_flags = PROT_READ, PROT_WRITE
+
+close$auto(fd intptr) (automatic)
+mmap$auto(addr intptr, len intptr, prot flags[prot_flags], flags intptr, fd intptr, off intptr) (automatic)
+open$auto(filename intptr, flags flags[o_flags], mode intptr) fd (automatic)
+_ = __NR_mmap2
+`
+	if got != want {
+		t.Fatalf("got output:\n%v\nwant:\n%v", got, want)
+	}
+	if err := validateOutput([]byte(got), nil); err != nil {
+		t.Fatal(err)
+	}
+	if res.decls["o_flags"].file != header || !strings.HasSuffix(res.decls["prot_flags"].file, "fcntl.h") {
+		t.Fatalf("wrong declaration origins: %+v", res.decls)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+// changedFiles returns C files changed in the kernelDir git checkout since rev (relative to kernelDir),
+// including uncommitted changes.
+func changedFiles(kernelDir, rev string) ([]string, error) {
+	out, err := osutil.RunCmd(time.Minute, kernelDir, "git", "diff", "--name-only", rev, "--")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range strings.Split(string(out), "\n") {
+		if strings.HasSuffix(file, ".c") {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// mergeOutput merges declarations and descriptions of the current run into the existing output file:
+// the ones with the same names are replaced, the rest of the existing ones are kept.
+// Descriptions of syscalls that were removed from the re-extracted files are kept as well.
+// If the file doesn't exist yet, decls and descs are returned as is.
+func mergeOutput(file string, decls, descs []string) ([]string, []string, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return decls, descs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	oldDecls, oldDescs := parseOutput(data)
+	decls = mergeLines(oldDecls, decls, func(line string) string {
+		name, _ := declarationName(line)
+		return name
+	})
+	slices.Sort(decls)
+	descs = mergeLines(oldDescs, descs, descriptionName)
+	return decls, descs, nil
+}
+
+// mergeLines returns lines with the old lines that don't have a line with the same key in lines.
+func mergeLines(old, lines []string, key func(string) string) []string {
+	keys := make(map[string]bool)
+	for _, line := range lines {
+		keys[key(line)] = true
+	}
+	res := slices.Clone(lines)
+	for _, line := range old {
+		if !keys[key(line)] {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+// parseOutput splits an output file produced by formatOutput back into declarations and descriptions.
+// Comments formatOutput moves to separate lines are attached back to the following descriptions.
+func parseOutput(data []byte) ([]string, []string) {
+	var decls, descs []string
+	comment := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" || line == outputHeader || line == outputTrailer {
+			continue
+		}
+		if text, ok := strings.CutPrefix(line, "# "); ok {
+			comment += " # " + text
+			continue
+		}
+		if _, ok := declarationName(line); ok {
+			decls = append(decls, line)
+			continue
+		}
+		line += comment
+		comment = ""
+		descs = append(descs, line)
+	}
+	return decls, descs
+}
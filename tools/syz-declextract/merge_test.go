@@ -0,0 +1,111 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+func TestChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@test"}, args...)
+		if _, err := osutil.RunCmd(time.Minute, dir, "git", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init")
+	writeFile(t, filepath.Join(dir, "fs", "a.c"), "a")
+	writeFile(t, filepath.Join(dir, "fs", "b.c"), "b")
+	writeFile(t, filepath.Join(dir, "mm", "c.c"), "c")
+	git("add", "-A")
+	git("commit", "-m", "first")
+	writeFile(t, filepath.Join(dir, "fs", "b.c"), "b2")
+	writeFile(t, filepath.Join(dir, "fs", "b.h"), "h")
+	git("add", "-A")
+	git("commit", "-m", "second")
+	writeFile(t, filepath.Join(dir, "mm", "c.c"), "c2") // uncommitted changes count too
+	changed, err := changedFiles(dir, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"fs/b.c", "mm/c.c"}, changed); diff != "" {
+		t.Fatal(diff)
+	}
+	cmds := []compileCommand{
+		{Directory: dir, File: "fs/a.c"},
+		{Directory: dir, File: "fs/b.c"},
+		{Directory: dir, File: filepath.Join(dir, "mm", "c.c")},
+	}
+	if diff := cmp.Diff(cmds[1:], selectCommands(cmds, dir, "", "", "HEAD~1")); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := selectCommands(cmds, dir, "", "", "HEAD"); len(got) != 1 {
+		t.Fatalf("got %+v, want only the uncommitted change", got)
+	}
+	if _, err := changedFiles(dir, "no-such-rev"); err == nil {
+		t.Fatal("no error for a bad revision")
+	}
+}
+
+func TestMergeOutputNew(t *testing.T) {
+	// The first incremental run has nothing to merge with.
+	decls, descs, err := mergeOutput(filepath.Join(t.TempDir(), "out.txt"), []string{"type a int32"}, []string{"b()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decls) != 1 || len(descs) != 1 {
+		t.Fatalf("got %q %q", decls, descs)
+	}
+}
+
+func TestMergeOutput(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "out.txt")
+	old := formatOutput([]string{"resource fd_a[int32]", "type b_t int32"}, []string{
+		"close$auto(fd intptr) (automatic)",
+		"ioctl$FOO(fd intptr, cmd const[FOO], arg ptr[in, array[int8, 8]]) (automatic) # TODO: describe struct foo",
+		"open$auto(file intptr, flags intptr) (automatic)",
+		"read$auto(fd intptr, buf intptr) (automatic)",
+	})
+	writeFile(t, file, string(old))
+	decls, descs, err := mergeOutput(file, []string{"type b_t int64", "type c_t int8"}, []string{
+		"open$auto(file intptr, flags intptr, mode intptr) (automatic)",
+		"write$auto(fd intptr, buf intptr) (automatic)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(formatOutput(decls, descs))
+	want := `# Code generated by syz-declextract. DO NOT EDIT.
+resource fd_a[int32]
+type b_t int64
+type c_t int8
+
+close$auto(fd intptr) (automatic)
+# TODO: describe struct foo
+ioctl$FOO(fd intptr, cmd const[FOO], arg ptr[in, array[int8, 8]]) (automatic)
+open$auto(file intptr, flags intptr, mode intptr) (automatic)
+read$auto(fd intptr, buf intptr) (automatic)
+write$auto(fd intptr, buf intptr) (automatic)
+_ = __NR_mmap2
+`
+	if got != want {
+		t.Fatalf("got output:\n%v\nwant:\n%v", got, want)
+	}
+	// Merging the same results again doesn't change anything.
+	writeFile(t, file, got)
+	decls, descs, err = mergeOutput(file, decls, descs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := string(formatOutput(decls, descs)); again != got {
+		t.Fatalf("merge is not idempotent:\n%v", again)
+	}
+}
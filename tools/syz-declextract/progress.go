@@ -0,0 +1,112 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress tracks the files that are being extracted, so that hung runs can be diagnosed.
+type progress struct {
+	mu      sync.Mutex
+	total   int
+	done    int
+	started int                 // number of started commands, used as their identity
+	running map[int]runningFile // keyed by command identity, the same file may be compiled several times
+	now     func() time.Time    // overridden in tests
+}
+
+type runningFile struct {
+	file  string
+	start time.Time
+}
+
+func newProgress(total int) *progress {
+	return &progress{
+		total:   total,
+		running: make(map[int]runningFile),
+		now:     time.Now,
+	}
+}
+
+// track wraps run to record the files that are being extracted.
+func (p *progress) track(run func(compileCommand) output) func(compileCommand) output {
+	return func(cmd compileCommand) output {
+		p.mu.Lock()
+		id := p.started
+		p.started++
+		p.running[id] = runningFile{cmd.File, p.now()}
+		p.mu.Unlock()
+		defer func() {
+			p.mu.Lock()
+			delete(p.running, id)
+			p.mu.Unlock()
+		}()
+		return run(cmd)
+	}
+}
+
+// handle wraps handle to count the handled outputs.
+func (p *progress) handle(handle func(output)) func(output) {
+	return func(out output) {
+		handle(out)
+		p.mu.Lock()
+		p.done++
+		p.mu.Unlock()
+	}
+}
+
+func (p *progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fmt.Sprintf("%v/%v files done, %v in progress", p.done, p.total, len(p.running))
+}
+
+// outstanding lists the files that are being extracted, the longest running first.
+func (p *progress) outstanding() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var files []runningFile
+	for _, file := range p.running {
+		files = append(files, file)
+	}
+	slices.SortFunc(files, func(a, b runningFile) int {
+		if res := a.start.Compare(b.start); res != 0 {
+			return res
+		}
+		return strings.Compare(a.file, b.file)
+	})
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "%v/%v files done, outstanding files:\n", p.done, p.total)
+	now := p.now()
+	for _, file := range files {
+		fmt.Fprintf(buf, "%v: running for %v\n", file.file, now.Sub(file.start).Round(time.Second))
+	}
+	return buf.String()
+}
+
+// report writes the progress to w every interval until the returned function is called.
+func (p *progress) report(w io.Writer, interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Fprintf(w, "%v\n", p)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressOutstanding(t *testing.T) {
+	cmds := []compileCommand{{File: "a.c"}, {File: "stuck.c"}, {File: "b.c"}, {File: "c.c"}}
+	p := newProgress(len(cmds))
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return start }
+	block := make(chan struct{})
+	run := func(cmd compileCommand) output {
+		if cmd.File == "stuck.c" {
+			<-block
+		}
+		return output{file: cmd.File}
+	}
+	done := make(chan int)
+	go func() {
+		done <- extractAll(cmds, 2, p.track(run), p.handle(func(output) {}), nil, 0)
+	}()
+	const want = "3/4 files done, 1 in progress"
+	for deadline := time.Now().Add(time.Minute); p.String() != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got progress %q, want %q", p.String(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.mu.Lock()
+	p.now = func() time.Time { return start.Add(5 * time.Minute) }
+	p.mu.Unlock()
+	report := "3/4 files done, outstanding files:\nstuck.c: running for 5m0s\n"
+	if got := p.outstanding(); got != report {
+		t.Errorf("got report:\n%v\nwant:\n%v", got, report)
+	}
+	close(block)
+	if processed := <-done; processed != len(cmds) {
+		t.Fatalf("processed %v files", processed)
+	}
+	if got := p.outstanding(); strings.Contains(got, "stuck.c") {
+		t.Errorf("finished file is reported as outstanding:\n%v", got)
+	}
+}
+
+func TestProgressSameFile(t *testing.T) {
+	// The same file may be compiled several times with different arguments.
+	cmds := []compileCommand{
+		{File: "a.c", Arguments: []string{"gcc", "-c", "a.c"}},
+		{File: "a.c", Arguments: []string{"gcc", "-DSTUCK", "-c", "a.c"}},
+	}
+	p := newProgress(len(cmds))
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return start }
+	var started sync.WaitGroup
+	started.Add(len(cmds))
+	block := make(chan struct{})
+	run := func(cmd compileCommand) output {
+		// Both commands run concurrently before the first one finishes.
+		started.Done()
+		started.Wait()
+		if slices.Contains(cmd.Arguments, "-DSTUCK") {
+			<-block
+		}
+		return output{file: cmd.File}
+	}
+	done := make(chan int)
+	go func() {
+		done <- extractAll(cmds, 2, p.track(run), p.handle(func(output) {}), nil, 0)
+	}()
+	const want = "1/2 files done, 1 in progress"
+	for deadline := time.Now().Add(time.Minute); p.String() != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got progress %q, want %q", p.String(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.mu.Lock()
+	p.now = func() time.Time { return start.Add(time.Minute) }
+	p.mu.Unlock()
+	report := "1/2 files done, outstanding files:\na.c: running for 1m0s\n"
+	if got := p.outstanding(); got != report {
+		t.Errorf("got report:\n%v\nwant:\n%v", got, report)
+	}
+	close(block)
+	if processed := <-done; processed != len(cmds) {
+		t.Fatalf("processed %v files", processed)
+	}
+	if got := p.String(); got != "2/2 files done, 0 in progress" {
+		t.Errorf("got progress %q after all files are done", got)
+	}
+}
+
+func TestProgressReport(t *testing.T) {
+	p := newProgress(10)
+	w := new(syncBuffer)
+	stop := p.report(w, time.Millisecond)
+	for deadline := time.Now().Add(time.Minute); !strings.Contains(w.String(), "0/10 files done"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("no progress reports")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+}
+
+// syncBuffer is a bytes.Buffer that can be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// returnResources maps names of syscalls (as used in the syscall tables) that return a new file descriptor
+// to the resource describing it in sys/linux. All SYSCALL_DEFINE functions return long, so resource
+// semantics can't be inferred from the return type and are taken from this list.
+// Syscalls that are not listed return the default plain integer.
+var returnResources = map[string]string{
+	"accept":                  "sock",
+	"accept4":                 "sock",
+	"creat":                   "fd",
+	"dup":                     "fd",
+	"dup2":                    "fd",
+	"dup3":                    "fd",
+	"epoll_create":            "fd_epoll",
+	"epoll_create1":           "fd_epoll",
+	"eventfd":                 "fd_event",
+	"eventfd2":                "fd_event",
+	"fanotify_init":           "fd_fanotify",
+	"fsmount":                 "fd",
+	"fsopen":                  "fd_fscontext",
+	"fspick":                  "fd_fscontext",
+	"inotify_init":            "fd_inotify",
+	"inotify_init1":           "fd_inotify",
+	"io_uring_setup":          "fd_io_uring",
+	"landlock_create_ruleset": "fd",
+	"memfd_create":            "fd_memfd",
+	"memfd_secret":            "fd",
+	"mq_open":                 "fd_mq",
+	"open":                    "fd",
+	"open_by_handle_at":       "fd",
+	"open_tree":               "fd",
+	"openat":                  "fd",
+	"openat2":                 "fd",
+	"pidfd_getfd":             "fd",
+	"pidfd_open":              "fd_pidfd",
+	"socket":                  "sock",
+	"timerfd_create":          "fd_timer",
+	"userfaultfd":             "fd_uffd",
+}
+
+// addReturnResource adds the return resource to the description of the syscall name
+// (e.g. "openat$auto(...) fd (automatic)"), if the syscall returns one.
+func addReturnResource(desc, name string) string {
+	resource := returnResources[name]
+	if resource == "" {
+		return desc
+	}
+	// Argument types may contain brackets, but not parentheses.
+	pos := strings.IndexByte(desc, ')')
+	if pos == -1 {
+		return desc
+	}
+	if rest := desc[pos+1:]; rest != "" && !strings.HasPrefix(rest, " (") && !strings.HasPrefix(rest, " #") {
+		return desc // the extractor has already emitted the return type
+	}
+	return desc[:pos+1] + " " + resource + desc[pos+1:]
+}
+
+// resourceStubs returns declarations of the given resources returned by the descriptions,
+// so that the descriptions can be compiled on their own, without the rest of sys/linux.
+// The compiler rejects resources that are never consumed, so the stub syscall consumes all of them.
+func resourceStubs(resources []string) []byte {
+	resources = slices.Clone(resources)
+	slices.Sort(resources)
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "resource fd[int32]: -1\n")
+	args := []string{"fd fd"}
+	for _, resource := range slices.Compact(resources) {
+		if resource == "fd" {
+			continue
+		}
+		fmt.Fprintf(buf, "resource %v[fd]\n", resource)
+		args = append(args, fmt.Sprintf("%v %v", resource, resource))
+	}
+	fmt.Fprintf(buf, "syz_declextract_stub(%v)\n", strings.Join(args, ", "))
+	return []byte(buf.String())
+}
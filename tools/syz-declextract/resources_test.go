@@ -0,0 +1,49 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReturnResources(t *testing.T) {
+	rename := map[string][]string{
+		"sys_socket": {"socket"},
+		"sys_openat": {"openat"},
+		"sys_close":  {"close"},
+	}
+	for desc, want := range map[string]string{
+		"sys_socket$auto(family intptr, type intptr, protocol intptr) (automatic)": "socket$auto(family intptr, " +
+			"type intptr, protocol intptr) sock (automatic)",
+		"sys_openat$auto(dfd intptr, filename intptr) (automatic) # TODO: foo": "openat$auto(dfd intptr, " +
+			"filename intptr) fd (automatic) # TODO: foo",
+		"sys_openat$auto(dfd intptr) fd_dir (automatic)": "openat$auto(dfd intptr) fd_dir (automatic)",
+		"sys_close$auto(fd intptr) (automatic)":          "close$auto(fd intptr) (automatic)",
+	} {
+		got := renameSyscall(desc, rename, nil)
+		if want := []string{want}; !slices.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", desc, got, want)
+		}
+	}
+}
+
+func TestValidateReturnResources(t *testing.T) {
+	data := formatOutput(nil, []string{
+		"socket$auto(family intptr, type intptr, protocol intptr) sock (automatic)",
+		"openat$auto(dfd intptr, filename intptr) fd (automatic)",
+		"close$auto(fd intptr) (automatic)",
+	})
+	if err := validateOutput(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Resources declared in the output are not stubbed.
+	data = formatOutput([]string{"resource fd[int32]"}, []string{
+		"openat$auto(dfd intptr, filename intptr) fd (automatic)",
+		"close$auto(fd fd) (automatic)",
+	})
+	if err := validateOutput(data, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,182 +5,1234 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/google/syzkaller/pkg/osutil"
 	"github.com/google/syzkaller/pkg/tool"
 	"github.com/google/syzkaller/sys/targets"
 )
 
 type compileCommand struct {
 	Arguments []string
+	Command   string // shell command line, used by databases without arguments
 	Directory string
 	File      string
 	Output    string
 }
 
+// args returns the compiler arguments of the command, split from the command string if there are no arguments.
+func (cmd compileCommand) args() []string {
+	if len(cmd.Arguments) != 0 {
+		return cmd.Arguments
+	}
+	return splitCommand(cmd.Command)
+}
+
 type output struct {
+	file   string
 	stdout string
 	stderr string
+	cached bool
 }
 
 func main() {
-	compilationDatabase := flag.String("compile_commands", "compile_commands.json", "path to compilation database")
+	compilationDatabase := flag.String("compile_commands", "compile_commands.json",
+		"path to compilation database, or - to read it from stdin, "+
+			"several comma-separated databases or globs are merged")
 	binary := flag.String("binary", "syz-declextract", "path to binary")
-	outFile := flag.String("output", "out.txt", "output file")
+	stripFlags := flag.String("strip-flags", strings.Join(defaultStripFlags, ","),
+		"comma-separated list of compiler flags to remove before extraction, trailing * matches any suffix")
+	outFile := flag.String("output", "out.txt", "output file, or - to write to stdout")
 	kernelDir := flag.String("kernel", "", "kernel directory")
+	filter := flag.String("filter", "", "comma-separated list of path prefixes or globs "+
+		"relative to the kernel directory, only matching files are processed")
+	excludeFileList := flag.String("exclude-files", strings.Join(defaultExcludeFiles, ","),
+		"comma-separated list of path prefixes or globs of files to skip (e.g. generated files), "+
+			"globs without / match file names")
+	compat := flag.Bool("compat", false, "also extract compat syscalls, they get a _compat variant suffix")
+	abis := flag.String("abi", "", "comma-separated list of syscall table ABIs to use (e.g. common,64), all by default")
+	tables := flag.String("tables", "", "comma-separated list of syscall table files or globs to use "+
+		"instead of the tables found under kernel arch directories")
+	strict := flag.Bool("strict", false, "fail on the first file that fails to compile")
+	timeout := flag.Duration("timeout", 5*time.Minute, "timeout for extraction from a single file")
+	jsonFile := flag.String("json", "", "additionally write extracted syscalls in JSON format to this file")
+	renameReport := flag.String("rename-report", "", "write extracted syscalls without syscall table entries "+
+		"and syscall table entries that were not extracted to this file")
+	coverageReport := flag.String("coverage-report", "", "write the percentage of syscalls with extracted "+
+		"descriptions and the list of syscalls without them to this file")
+	perArch := flag.Bool("per-arch", false, "write a separate output file for each arch directory")
+	exclude := flag.String("exclude", "",
+		"comma-separated list of syscalls to exclude, or a file with one syscall per line")
+	noDefaultExclude := flag.Bool("no-default-exclude", false, "don't exclude the built-in list of syscalls")
+	cacheDir := flag.String("cache", "", "directory to cache per-file extraction results in")
+	validate := flag.Bool("validate", false, "check that the descriptions compile before writing them")
+	types := flag.Bool("types", false, "emit shared type declarations for struct arguments, "+
+		"and resource and type declarations produced by the extractor")
+	retries := flag.Int("retries", 2, "number of times to retry files after transient extractor failures "+
+		"(e.g. killed by a signal)")
+	jobs := flag.Int("jobs", runtime.NumCPU(), fmt.Sprintf("number of files to process in parallel "+
+		"(at most %v per CPU)", maxJobsPerCPU))
+	progressInterval := flag.Duration("progress", 30*time.Second, "interval of progress reports, 0 disables them")
+	deadline := flag.Duration("deadline", 0, "abort the run if it takes longer than this, "+
+		"listing the files that are still being extracted (0 means no deadline)")
+	since := flag.String("since", "", "only extract files changed in the kernel git checkout since this revision, "+
+		"and merge the results into the existing output")
+	locations := flag.Bool("locations", false, "precede descriptions with \"# source: file:line\" comments")
+	minDescriptions := flag.Int("min-descriptions", 0, "fail without writing the output "+
+		"if fewer descriptions are extracted (e.g. due to a wrong -kernel or -binary)")
+	merge := flag.Bool("merge", false, "merge the results into the existing output file, "+
+		"replacing only descriptions of the extracted syscalls")
+	flagsHeaders := flag.String("flags-headers", "", "comma-separated list of headers or globs "+
+		"to take flag constants (e.g. O_RDONLY) for integer syscall arguments from")
+	var env envFlag
+	flag.Var(&env, "env", "KEY=VAL environment variable for the extractor, or a file with KEY=VAL lines "+
+		"(can be repeated)")
 	flag.Parse()
-	if *kernelDir == "" {
-		tool.Failf("path to kernel directory is required")
+	if *kernelDir == "" && *tables == "" {
+		failf("path to kernel directory or syscall tables is required")
+	}
+	if *jobs < 1 {
+		failf("-jobs must be at least 1")
+	}
+	if *perArch && *outFile == "-" {
+		failf("-per-arch can't be used with -output -")
+	}
+	if *since != "" && (*outFile == "-" || *kernelDir == "") {
+		failf("-since requires -kernel and an -output file to merge into")
+	}
+	if *merge && *outFile == "-" {
+		failf("-merge can't be used with -output -")
+	}
+	// Fail early instead of spawning a doomed process for every file.
+	binaryPath, err := checkBinary(*binary)
+	if err != nil {
+		fail(err)
+	}
+	excluded, err := makeExcludeList(*exclude, *noDefaultExclude)
+	if err != nil {
+		fail(err)
+	}
+
+	// Fatal errors exit without running deferred calls, so the cleanups are run by fail as well.
+	defer runCleanups()
+	dbFile, cmds, stripped := loadCommands(*compilationDatabase, *stripFlags)
+	cmds = selectCommands(cmds, *kernelDir, *filter, *excludeFileList, *since)
+
+	ex := newExtractor(binaryPath, dbFile, *timeout, env, *retries, *cacheDir, *types)
+	// Some syscalls have different names and entry points and thus need to be renamed.
+	// e.g. SYSCALL_DEFINE1(setuid16, old_uid_t, uid) is referred to in the .tbl file with setuid.
+	archSyscallNames := loadSyscallNames(*kernelDir, *tables, makeTableOptions(*compat, *abis))
+	var flagSets flagGroups
+	if *flagsHeaders != "" {
+		if flagSets, err = readFlagHeaders(*flagsHeaders); err != nil {
+			fail(err)
+		}
+	}
+	res := &results{
+		archSyscallNames: archSyscallNames,
+		syscallNames:     mergeSyscallNames(archSyscallNames),
+		excluded:         excluded,
+		strict:           *strict,
+		perArch:          *perArch,
+		json:             *jsonFile != "",
+		types:            *types,
+		flags:            flagSets,
+		renameReport:     *renameReport != "",
+		matched:          make(map[string]bool),
+		dropped:          make(map[string]bool),
+		decls:            make(declarations),
+		archOut:          make(map[string][]string),
+		origins:          make(map[string]string),
+		kernelDir:        *kernelDir,
+		locations:        *locations,
+		sourceLines:      make(map[string]string),
+	}
+	processed := extractWithProgress(cmds, clampJobs(*jobs, len(cmds), runtime.NumCPU()), ex.run, res.add,
+		*progressInterval, *deadline)
+
+	if err := checkDescriptionCount(res.allOut, *minDescriptions); err != nil {
+		fail(err)
 	}
+	for file, data := range res.formatOutputs(*outFile, *validate, *merge || *since != "") {
+		writeOutput(data, file)
+	}
+	if *jsonFile != "" {
+		writeJSON(res.syscalls, *jsonFile)
+	}
+	res.writeReports(*renameReport, *coverageReport)
+	res.printSummary(len(cmds), stripped, *cacheDir != "")
+	if processed != len(cmds) {
+		failf("interrupted, wrote partial results for %v/%v files", processed, len(cmds))
+	}
+}
+
+var (
+	cleanupMu sync.Mutex
+	cleanups  []func()
+)
+
+// atExit registers f to be run when the tool exits (e.g. to remove temp files).
+func atExit(f func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	cleanups = append(cleanups, f)
+}
+
+// runCleanups runs the functions registered with atExit in the reverse order, at most once.
+// Concurrent callers wait for the cleanups to finish, so that nobody exits in the middle of them.
+func runCleanups() {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+	cleanups = nil
+}
+
+// fail is tool.Fail that runs the cleanups first, since os.Exit doesn't run deferred calls.
+func fail(err error) {
+	runCleanups()
+	tool.Fail(err)
+}
+
+// failf is tool.Failf that runs the cleanups first.
+func failf(msg string, args ...interface{}) {
+	runCleanups()
+	tool.Failf(msg, args...)
+}
+
+// writeReports writes the rename and coverage reports to the files, if they are set.
+func (res *results) writeReports(renameReport, coverageReport string) {
+	if renameReport != "" {
+		writeOutput(formatRenameReport(res.syscallNames, res.matched, res.dropped), renameReport)
+	}
+	if coverageReport != "" {
+		report, percent := formatCoverageReport(res.syscallNames, res.allOut, res.excluded)
+		writeOutput(report, coverageReport)
+		fmt.Fprintf(os.Stderr, "extracted descriptions for %.1f%% of syscalls\n", percent)
+	}
+}
 
-	fileData, err := os.ReadFile(*compilationDatabase)
+// printSummary prints statistics and errors of the run.
+func (res *results) printSummary(total, stripped int, cache bool) {
+	if cache {
+		fmt.Fprintf(os.Stderr, "%v/%v files served from cache\n", res.cached, total)
+	}
+	if stripped != 0 {
+		fmt.Fprintf(os.Stderr, "removed unsupported compiler flags for %v compile commands\n", stripped)
+	}
+	if len(res.failed) != 0 {
+		fmt.Fprint(os.Stderr, errorSummary(res.failed, total))
+	}
+}
+
+// checkDescriptionCount returns an error if there are fewer than minCount distinct descriptions.
+// Then the output is not written, so that a misconfigured run doesn't overwrite a good output.
+func checkDescriptionCount(descs []string, minCount int) error {
+	names := make(map[string]bool)
+	for _, desc := range descs {
+		names[descriptionName(desc)] = true
+	}
+	if len(names) < minCount {
+		return fmt.Errorf("extracted %v descriptions, expected at least %v, not writing the output",
+			len(names), minCount)
+	}
+	return nil
+}
+
+// loadCommands reads and validates the compilation databases, and returns the database file
+// for the extractor binary. A temporary database is removed when the tool exits.
+func loadCommands(compilationDatabase, stripFlags string) (string, []compileCommand, int) {
+	var stripList []string
+	if stripFlags != "" {
+		stripList = strings.Split(stripFlags, ",")
+	}
+	dbFiles, err := expandDatabases(compilationDatabase)
 	if err != nil {
-		tool.Fail(err)
+		fail(err)
 	}
+	dbFile, cmds, stripped, err := readCompilationDatabases(dbFiles, os.Stdin, stripList)
+	if err != nil {
+		fail(err)
+	}
+	if len(dbFiles) != 1 || dbFile != dbFiles[0] {
+		atExit(func() { os.RemoveAll(filepath.Dir(dbFile)) })
+	}
+	if err := validateCommands(cmds); err != nil {
+		fail(err)
+	}
+	return dbFile, cmds, stripped
+}
 
-	var cmds []compileCommand
-	if err := json.Unmarshal(fileData, &cmds); err != nil {
-		tool.Fail(err)
+// selectCommands returns the commands to extract from: the ones matching the filter,
+// not matching the exclude patterns, changed since the git revision, without duplicates.
+func selectCommands(cmds []compileCommand, kernelDir, filter, exclude, since string) []compileCommand {
+	if filter != "" {
+		cmds = filterCommands(cmds, kernelDir, strings.Split(filter, ","))
 	}
+	if exclude != "" {
+		var skipped int
+		cmds, skipped = excludeFiles(cmds, kernelDir, strings.Split(exclude, ","))
+		if skipped != 0 {
+			fmt.Fprintf(os.Stderr, "skipped %v excluded files\n", skipped)
+		}
+	}
+	if since != "" {
+		changed, err := changedFiles(kernelDir, since)
+		if err != nil {
+			fail(err)
+		}
+		if len(changed) == 0 {
+			cmds = nil // no filters means all files for filterCommands
+		} else {
+			cmds = filterCommands(cmds, kernelDir, changed)
+		}
+		fmt.Fprintf(os.Stderr, "%v files changed since %v\n", len(cmds), since)
+	}
+	cmds, duplicates, conflicting := dedupCommands(cmds)
+	if duplicates != 0 {
+		fmt.Fprintf(os.Stderr, "skipped %v duplicate compile commands\n", duplicates)
+	}
+	for _, file := range conflicting {
+		fmt.Fprintf(os.Stderr, "warning: %v is compiled with different arguments, extracting all variants\n", file)
+	}
+	return cmds
+}
 
-	outputs := make(chan output, len(cmds))
-	files := make(chan string, len(cmds))
-	for w := 0; w < runtime.NumCPU(); w++ {
-		go worker(outputs, files, *binary, *compilationDatabase)
+func loadSyscallNames(kernelDir, tables string, opts tableOptions) map[string]map[string][]string {
+	if tables == "" {
+		return readSyscallNames(kernelDir, opts)
 	}
+	archSyscallNames, err := readCustomSyscallNames(tables, opts)
+	if err != nil {
+		fail(err)
+	}
+	return archSyscallNames
+}
 
-	for _, v := range cmds {
-		files <- v.File
+// formatOutputs returns contents of all output files (one file, or one per arch).
+// All outputs are formatted (and validated) before any of them is written,
+// so that the previous good output is not overwritten with invalid descriptions.
+// If merge is set, the results are merged into the existing output files.
+func (res *results) formatOutputs(outFile string, validate, merge bool) map[string][]byte {
+	outputs := map[string][]string{outFile: res.allOut}
+	if res.perArch {
+		outputs = make(map[string][]string)
+		for arch, names := range res.archSyscallNames {
+			if len(names) != 0 {
+				outputs[perArchFile(outFile, arch)] = res.archOut[arch]
+			}
+		}
 	}
+	outputData := make(map[string][]byte)
+	for file, descs := range outputs {
+		decls := res.decls.sorted()
+		if res.locations {
+			descs = res.addLocations(descs)
+		}
+		if merge {
+			var err error
+			if decls, descs, err = mergeOutput(file, decls, descs); err != nil {
+				fail(err)
+			}
+		}
+		outputData[file] = formatOutput(decls, descs)
+		if validate {
+			if err := validateOutput(outputData[file], res.origins); err != nil {
+				fail(err)
+			}
+		}
+	}
+	return outputData
+}
 
-	var allOut []string
-	syscallNames := readSyscallNames(filepath.Join(*kernelDir, "arch")) // some syscalls have different names and entry
-	// points and thus need to be renamed.
-	// e.g. SYSCALL_DEFINE1(setuid16, old_uid_t, uid) is referred to in the .tbl file with setuid.
-	for range cmds {
-		out := <-outputs
-		if out.stderr != "" {
-			tool.Failf("%s", out.stderr)
+// handleInterrupts returns a channel that is closed on the first SIGINT/SIGTERM,
+// the second signal terminates the process immediately.
+func handleInterrupts() <-chan struct{} {
+	stop := make(chan struct{})
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		fmt.Fprintf(os.Stderr, "interrupted: finishing files in progress and writing partial results...\n")
+		close(stop)
+		<-c
+		fmt.Fprintf(os.Stderr, "interrupted again: terminating\n")
+		runCleanups()
+		os.Exit(1)
+	}()
+	return stop
+}
+
+// maxJobsPerCPU limits -jobs, every job is a separate CPU-bound extractor process.
+const maxJobsPerCPU = 4
+
+// clampJobs limits the number of workers to the number of files, since there is no point in having more,
+// and to maxJobsPerCPU per CPU, so that an absurd -jobs value doesn't start thousands of processes.
+func clampJobs(jobs, files, cpus int) int {
+	return min(jobs, files, maxJobsPerCPU*cpus)
+}
+
+// extractWithProgress is extractAll that reports progress every interval (if non-zero) and aborts the run
+// after deadline (if non-zero) listing the files that are still being extracted.
+func extractWithProgress(cmds []compileCommand, jobs int, run func(compileCommand) output, handle func(output),
+	interval, deadline time.Duration) int {
+	p := newProgress(len(cmds))
+	if interval != 0 {
+		defer p.report(os.Stderr, interval)()
+	}
+	if deadline != 0 {
+		timer := time.AfterFunc(deadline, func() {
+			failf("deadline of %v exceeded, %v", deadline, strings.TrimSpace(p.outstanding()))
+		})
+		defer timer.Stop()
+	}
+	return extractAll(cmds, jobs, p.track(run), p.handle(handle), handleInterrupts(), 10*time.Second)
+}
+
+// extractAll runs extraction for all cmds on jobs workers and passes outputs to handle
+// in the order they become available. All channels are bounded, so memory usage
+// does not depend on the number of commands.
+// Once stop is closed, no new files are dispatched, and extractAll waits for at most grace
+// for the files that are already being processed. Returns the number of handled outputs.
+func extractAll(cmds []compileCommand, jobs int, run func(compileCommand) output, handle func(output),
+	stop <-chan struct{}, grace time.Duration) int {
+	files := make(chan compileCommand)
+	outputs := make(chan output, jobs)
+	dispatched := make(chan int, 1)
+	// Files are sent from a separate goroutine, otherwise sending could block on workers
+	// that are blocked on sending outputs that nobody reads yet.
+	go func() {
+		sent := 0
+	loop:
+		for _, cmd := range cmds {
+			// Check stop first, select chooses randomly between ready cases.
+			select {
+			case <-stop:
+				break loop
+			default:
+			}
+			select {
+			case files <- cmd:
+				sent++
+			case <-stop:
+				break loop
+			}
 		}
-		for _, line := range strings.Split(out.stdout, "\n") {
-			if line == "" {
-				continue
+		close(files)
+		dispatched <- sent
+	}()
+	startWorkers(jobs, outputs, files, run)
+	handled, total := 0, -1
+	stopped := stop
+	var graceTimeout <-chan time.Time
+	for handled != total {
+		select {
+		case out := <-outputs:
+			handle(out)
+			handled++
+		case total = <-dispatched:
+		case <-stopped:
+			stopped = nil
+			graceTimeout = time.After(grace)
+		case <-graceTimeout:
+			return handled
+		}
+	}
+	return handled
+}
+
+// results accumulates extracted descriptions.
+type results struct {
+	archSyscallNames map[string]map[string][]string
+	syscallNames     map[string][]string
+	excluded         excludeList
+	strict           bool
+	perArch          bool
+	json             bool
+	types            bool
+	locations        bool
+	kernelDir        string // source locations are relative to it
+	flags            flagGroups
+	renameReport     bool
+
+	decls    declarations
+	allOut   []string
+	archOut  map[string][]string
+	origins  map[string]string // full syscall name -> source file
+	syscalls []*syscallInfo
+	matched  map[string]bool // syscall table entries used by extracted descriptions
+	dropped  map[string]bool // extracted syscalls without syscall table entries
+	failed   []output
+	cached   int
+	// Description (without comments) -> source location (file:line) of its definition.
+	// Descriptions with the same name can come from different files, so they are not keyed by name.
+	sourceLines map[string]string
+}
+
+func (res *results) add(out output) {
+	if out.cached {
+		res.cached++
+	}
+	if out.stderr != "" {
+		if res.strict {
+			failf("%v: %v", out.file, out.stderr)
+		}
+		res.failed = append(res.failed, out)
+		return
+	}
+	location := ""
+	for _, line := range strings.Split(out.stdout, "\n") {
+		if line == "" {
+			continue
+		}
+		if loc, ok := strings.CutPrefix(line, locationPrefix); ok {
+			location = res.relativeLocation(loc)
+			continue
+		}
+		if name, ok := declarationName(line); ok {
+			if res.types {
+				res.addDecl(name, line, out.file)
+			}
+			continue
+		}
+		if res.renameReport {
+			if key := renameKey(line); res.syscallNames[key] != nil {
+				res.matched[key] = true
+			} else {
+				res.dropped[key] = true
+			}
+		}
+		var usedFlags []string
+		line, usedFlags = res.flags.apply(line)
+		renamed := renameSyscall(line, res.syscallNames, res.excluded)
+		if len(renamed) != 0 {
+			for _, prefix := range usedFlags {
+				res.addDecl(flagsName(prefix), res.flags.decl(prefix), res.flags[prefix].file)
+			}
+		}
+		res.allOut = append(res.allOut, renamed...)
+		for _, desc := range renamed {
+			res.origins[descriptionName(desc)] = out.file
+			if location != "" {
+				desc, _, _ = strings.Cut(desc, " # ")
+				res.sourceLines[desc] = location
+			}
+		}
+		if res.perArch {
+			for arch, names := range res.archSyscallNames {
+				res.archOut[arch] = append(res.archOut[arch], renameSyscall(line, names, res.excluded)...)
+			}
+		}
+		if res.json && len(renamed) != 0 {
+			info := makeSyscallInfo(out.file, line, res.syscallNames, res.excluded)
+			info.Location = location
+			if location != "" && res.kernelDir != "" {
+				info.Configs, _ = configDeps(res.kernelDir, location)
 			}
-			allOut = append(allOut, renameSyscall(line, syscallNames)...)
+			res.syscalls = append(res.syscalls, info)
 		}
+		location = ""
 	}
-	close(files)
-	writeOutput(allOut, *outFile)
 }
 
-func writeOutput(allOut []string, outFile string) {
-	slices.Sort(allOut)
-	allOut = slices.CompactFunc(allOut, func(a string, b string) bool {
-		// We only compare the part before "$" for cases where the same system call has different parameter names,
-		// but share the same syzkaller type. NOTE:Change when we have better type extraction.
-		return strings.Split(a, "$")[0] == strings.Split(b, "$")[0]
+// locationPrefix precedes the source location of the following description in the extractor output.
+const locationPrefix = "# location: "
+
+// relativeLocation returns the file:line location relative to the kernel directory, if it's inside of it.
+func (res *results) relativeLocation(loc string) string {
+	if !filepath.IsAbs(loc) || res.kernelDir == "" {
+		return loc
+	}
+	if rel, err := filepath.Rel(res.kernelDir, loc); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return loc
+}
+
+// addLocations appends the source locations to the descriptions as comments.
+func (res *results) addLocations(descs []string) []string {
+	descs = slices.Clone(descs)
+	for i, desc := range descs {
+		text, _, _ := strings.Cut(desc, " # ")
+		if loc := res.sourceLines[text]; loc != "" {
+			// Plain "# include/..." would look like an include directive to the parser.
+			descs[i] = desc + " # source: " + loc
+		}
+	}
+	return descs
+}
+
+func (res *results) addDecl(name, line, file string) {
+	if err := res.decls.add(name, line, file); err != nil {
+		if res.strict {
+			failf("%v: %v", file, err)
+		}
+		res.failed = append(res.failed, output{file: file, stderr: err.Error()})
+	}
+}
+
+// errorSummary lists the failed files sorted by name, so that summaries are diffable across runs.
+func errorSummary(failed []output, total int) string {
+	failed = slices.Clone(failed)
+	slices.SortFunc(failed, func(a, b output) int {
+		return strings.Compare(a.file, b.file)
 	})
-	err := os.WriteFile(outFile,
-		[]byte("# Code generated by syz-declextract. DO NOT EDIT.\n"+strings.Join(allOut, "\n")+"\n_ = __NR_mmap2\n"), 0666)
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "%v/%v files failed:\n", len(failed), total)
+	for _, out := range failed {
+		fmt.Fprintf(buf, "%v: %v\n", out.file, strings.TrimSpace(out.stderr))
+	}
+	return buf.String()
+}
+
+func writeOutput(data []byte, outFile string) {
+	var err error
+	if outFile == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(outFile, data, 0666)
+	}
 	if err != nil {
-		tool.Fail(err)
+		fail(err)
 	}
 }
 
-func worker(outputs chan output, files chan string, binary, compilationDatabase string) {
-	for file := range files {
-		if !strings.HasSuffix(file, ".c") {
-			outputs <- output{}
-			return
+const (
+	outputHeader  = "# Code generated by syz-declextract. DO NOT EDIT."
+	outputTrailer = "_ = __NR_mmap2"
+)
+
+func formatOutput(decls, allOut []string) []byte {
+	allOut = slices.Clone(allOut)
+	slices.SortFunc(allOut, compareDescriptions)
+	// Descriptions with the same full name (including the $variant) can't coexist in one file,
+	// but different variants of the same syscall are all kept. The best description goes first.
+	allOut = slices.CompactFunc(allOut, func(a, b string) bool {
+		return descriptionName(a) == descriptionName(b)
+	})
+	for i, desc := range allOut {
+		// The extractor may append a TODO comment to descriptions it can't fully resolve,
+		// and the source location may be appended as well, but comments must be on separate lines.
+		if parts := strings.Split(desc, " # "); len(parts) > 1 {
+			allOut[i] = "# " + strings.Join(parts[1:], "\n# ") + "\n" + parts[0]
 		}
+	}
+	header := outputHeader + "\n"
+	if len(decls) != 0 {
+		header += strings.Join(decls, "\n") + "\n\n"
+	}
+	return []byte(header + strings.Join(allOut, "\n") + "\n" + outputTrailer + "\n")
+}
 
-		cmd := exec.Command(binary, "-p", compilationDatabase, file)
-		stdout, err := cmd.Output()
-		var stderr string
-		if err != nil {
-			var error *exec.ExitError
-			if errors.As(err, &error) {
-				stderr = string(error.Stderr)
-			} else {
-				stderr = err.Error()
+// compareDescriptions orders descriptions by full name, and descriptions with the same name
+// (extracted from different files) from the best to the worst: the one with the most resolved
+// argument types (not intptr) wins, ties are broken by lexical order.
+func compareDescriptions(a, b string) int {
+	if res := strings.Compare(descriptionName(a), descriptionName(b)); res != 0 {
+		return res
+	}
+	if ra, rb := resolvedArgs(a), resolvedArgs(b); ra != rb {
+		return cmp.Compare(rb, ra)
+	}
+	return strings.Compare(a, b)
+}
+
+func resolvedArgs(desc string) int {
+	_, args := parseDescription(desc)
+	resolved := 0
+	for _, arg := range args {
+		if arg.Type != "intptr" {
+			resolved++
+		}
+	}
+	return resolved
+}
+
+// descriptionName returns the full syscall name of the description (e.g. "ioctl$FOO").
+func descriptionName(desc string) string {
+	name, _, _ := strings.Cut(desc, "(")
+	return strings.TrimSpace(name)
+}
+
+// syscallInfo is the JSON representation of an extracted syscall.
+type syscallInfo struct {
+	File  string    `json:"file"`
+	Name  string    `json:"name"`  // name used in SYSCALL_DEFINE
+	Names []string  `json:"names"` // names used in the syscall tables
+	Args  []argInfo `json:"args"`
+	// Location of the definition (file:line), if reported by the extractor.
+	Location string `json:"location,omitempty"`
+	// Kernel configs the syscall depends on, omitted if they can't be determined.
+	Configs []string `json:"configs,omitempty"`
+}
+
+type argInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func makeSyscallInfo(file, desc string, rename map[string][]string, excluded excludeList) *syscallInfo {
+	name, args := parseDescription(desc)
+	info := &syscallInfo{
+		File: file,
+		Name: name,
+		Args: args,
+	}
+	for _, newName := range rename[name] {
+		if !excluded.isProhibited(newName) {
+			info.Names = append(info.Names, newName)
+		}
+	}
+	return info
+}
+
+// parseDescription splits a description like "read$auto(fd intptr, buf intptr) (automatic)"
+// into the base syscall name and its arguments.
+func parseDescription(desc string) (string, []argInfo) {
+	name := desc
+	if pos := strings.IndexAny(desc, "$("); pos != -1 {
+		name = desc[:pos]
+	}
+	start := strings.IndexByte(desc, '(')
+	if start == -1 {
+		return name, nil
+	}
+	var args []argInfo
+	depth, argStart := 0, start+1
+	for i := start + 1; i < len(desc); i++ {
+		switch c := desc[i]; {
+		case c == '(' || c == '[':
+			depth++
+		case c == ']' || c == ')' && depth != 0:
+			depth--
+		case c == ',' && depth == 0 || c == ')':
+			if arg := strings.TrimSpace(desc[argStart:i]); arg != "" {
+				argName, argType, _ := strings.Cut(arg, " ")
+				args = append(args, argInfo{Name: argName, Type: strings.TrimSpace(argType)})
+			}
+			if c == ')' {
+				return name, args
 			}
+			argStart = i + 1
+		}
+	}
+	return name, args
+}
+
+func writeJSON(syscalls []*syscallInfo, outFile string) {
+	slices.SortFunc(syscalls, func(a, b *syscallInfo) int {
+		if a.Name != b.Name {
+			return strings.Compare(a.Name, b.Name)
+		}
+		return strings.Compare(a.File, b.File)
+	})
+	data, err := json.MarshalIndent(syscalls, "", "\t")
+	if err != nil {
+		fail(err)
+	}
+	if err := os.WriteFile(outFile, append(data, '\n'), 0666); err != nil {
+		fail(err)
+	}
+}
+
+func startWorkers(jobs int, outputs chan output, files chan compileCommand, run func(compileCommand) output) {
+	for w := 0; w < jobs; w++ {
+		go worker(outputs, files, run)
+	}
+}
+
+func worker(outputs chan output, files chan compileCommand, run func(compileCommand) output) {
+	for cmd := range files {
+		if !strings.HasSuffix(cmd.File, ".c") {
+			outputs <- output{file: cmd.File}
+			continue
 		}
-		outputs <- output{string(stdout), stderr}
+		outputs <- run(cmd)
 	}
 }
 
-func renameSyscall(desc string, rename map[string][]string) []string {
+// extractor runs the extractor binary on individual files.
+type extractor struct {
+	binary              string
+	compilationDatabase string
+	timeout             time.Duration
+	cacheDir            string
+	binaryHash          []byte
+	env                 []string // set in addition to the inherited environment
+	retries             int      // number of retries after transient failures
+	backoff             time.Duration
+	types               bool // the extractor emits type declarations for struct arguments
+}
+
+func newExtractor(binary, compilationDatabase string, timeout time.Duration, env []string,
+	retries int, cacheDir string, types bool) *extractor {
+	ex := &extractor{
+		binary:              binary,
+		compilationDatabase: compilationDatabase,
+		timeout:             timeout,
+		env:                 env,
+		retries:             retries,
+		backoff:             time.Second,
+		types:               types,
+	}
+	if cacheDir != "" {
+		if err := ex.initCache(cacheDir); err != nil {
+			fail(err)
+		}
+	}
+	return ex
+}
+
+func (ex *extractor) run(cmd compileCommand) output {
+	key := ex.cacheKey(cmd)
+	if out, ok := ex.cacheLookup(key); ok {
+		out.file = cmd.File
+		return out
+	}
+	out := ex.extract(cmd.File)
+	if out.stderr == "" {
+		ex.cacheStore(key, out)
+	}
+	return out
+}
+
+// checkBinary checks that the extractor binary exists and is executable.
+// Returns the path to the binary, it's looked up in PATH if it doesn't contain a slash.
+func checkBinary(binary string) (string, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return "", fmt.Errorf("extractor binary is not usable: %w", err)
+	}
+	return path, nil
+}
+
+// extract runs the extractor on the file, and retries it with exponential backoff if it fails
+// for a reason that's likely transient.
+func (ex *extractor) extract(file string) output {
+	for attempt := 0; ; attempt++ {
+		out, transient := ex.extractOnce(file)
+		if !transient || attempt >= ex.retries {
+			return out
+		}
+		time.Sleep(ex.backoff << attempt)
+	}
+}
+
+// extractOnce runs the extractor on the file once. Failures to start the process due to resource exhaustion
+// and deaths from signals (e.g. from the OOM killer) are transient, compilation errors and timeouts are not.
+func (ex *extractor) extractOnce(file string) (output, bool) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	args := []string{"-p", ex.compilationDatabase, file}
+	if ex.types {
+		args = append(args, "-types")
+	}
+	cmd := osutil.Command(ex.binary, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if len(ex.env) != 0 {
+		// Later values take precedence, so the configured variables override the inherited ones.
+		cmd.Env = append(os.Environ(), ex.env...)
+	}
+	// osutil.Run kills the whole process group on timeout.
+	_, err := osutil.Run(ex.timeout, cmd)
+	out := output{file: file, stdout: stdout.String()}
+	transient := false
+	if err != nil {
+		var verbose *osutil.VerboseError
+		switch {
+		case errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOMEM):
+			out.stderr = err.Error()
+			transient = true
+		case errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission):
+			// The binary can't be started at all, this will fail for all files.
+			failf("failed to run the extractor: %v", err)
+		case errors.As(err, &verbose) && verbose.Timedout:
+			out.stderr = fmt.Sprintf("timed out after %v", ex.timeout)
+		case stderr.Len() != 0:
+			out.stderr = stderr.String()
+		default:
+			out.stderr = err.Error()
+		}
+		// ExitStatus is -1 if the process was killed by a signal.
+		transient = transient || verbose != nil && !verbose.Timedout && verbose.ExitCode == -1
+	}
+	return out, transient
+}
+
+// renameKey returns the name the description is looked up by in the syscall table renames.
+// Descriptions of syscalls without arguments (SYSCALL_DEFINE0) or without a variant
+// (e.g. "sync()") are handled as well.
+func renameKey(desc string) string {
+	if pos := strings.IndexAny(desc, "$("); pos != -1 {
+		return desc[:pos]
+	}
+	return desc
+}
+
+// formatRenameReport lists extracted syscalls that were dropped because they have no syscall table entries,
+// and syscall table entries that were not matched by any extracted syscall.
+func formatRenameReport(rename map[string][]string, matched, dropped map[string]bool) []byte {
+	var unmatched []string
+	for key := range rename {
+		if !matched[key] {
+			unmatched = append(unmatched, key)
+		}
+	}
+	slices.Sort(unmatched)
+	droppedList := make([]string, 0, len(dropped))
+	for key := range dropped {
+		droppedList = append(droppedList, key)
+	}
+	slices.Sort(droppedList)
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# %v extracted syscalls without syscall table entries:\n", len(droppedList))
+	for _, key := range droppedList {
+		fmt.Fprintf(buf, "%v\n", key)
+	}
+	fmt.Fprintf(buf, "\n# %v syscall table entries without extracted syscalls:\n", len(unmatched))
+	for _, key := range unmatched {
+		fmt.Fprintf(buf, "%v\n", key)
+	}
+	return buf.Bytes()
+}
+
+// formatCoverageReport lists syscalls from the syscall tables (except for the excluded ones)
+// that have no extracted descriptions, and returns the percentage of syscalls that have them.
+func formatCoverageReport(rename map[string][]string, descs []string, excluded excludeList) ([]byte, float64) {
+	described := make(map[string]bool)
+	for _, desc := range descs {
+		described[renameKey(desc)] = true
+	}
+	all := make(map[string]bool)
+	for _, names := range rename {
+		for _, name := range names {
+			if !excluded.isProhibited(name) {
+				all[name] = true
+			}
+		}
+	}
+	var missing []string
+	for name := range all {
+		if !described[name] {
+			missing = append(missing, name)
+		}
+	}
+	slices.Sort(missing)
+	percent := 100.0
+	if len(all) != 0 {
+		percent = float64(len(all)-len(missing)) * 100 / float64(len(all))
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# extracted descriptions for %v/%v syscalls (%.1f%%)\n", len(all)-len(missing), len(all), percent)
+	fmt.Fprintf(buf, "\n# %v syscalls without descriptions:\n", len(missing))
+	for _, name := range missing {
+		fmt.Fprintf(buf, "%v\n", name)
+	}
+	return buf.Bytes(), percent
+}
+
+func renameSyscall(desc string, rename map[string][]string, excluded excludeList) []string {
 	var renamed []string
-	toReplace := strings.Split(desc, "$")[0]
+	toReplace := renameKey(desc)
 	if rename[toReplace] == nil {
 		// Syscall has no record in the tables for the architectures we support.
 		return nil
 	}
 
 	for _, name := range rename[toReplace] {
-		if isProhibited(name) {
+		if excluded.isProhibited(name) {
 			continue
 		}
-		renamed = append(renamed, strings.Replace(desc, toReplace, name, 1))
+		// Only the leading syscall name is replaced, the same string may also appear
+		// in the variant suffix or in argument names.
+		variant, args, hasArgs := strings.Cut(desc[len(toReplace):], "(")
+		if strings.HasPrefix(toReplace, compatPrefix) {
+			// Compat syscalls share names with the native ones, so they get a distinct variant.
+			if variant != "" {
+				variant += "_compat"
+			} else {
+				variant = "$compat"
+			}
+		}
+		newDesc := name + variant
+		if hasArgs {
+			newDesc += "(" + args
+		}
+		renamed = append(renamed, addReturnResource(newDesc, name))
 	}
 	return renamed
 }
 
-func readSyscallNames(kernelDir string) map[string][]string {
-	var rename = make(map[string][]string)
+// tableOptions control which syscall table entries are used.
+type tableOptions struct {
+	compat bool            // record compat entry points
+	abis   map[string]bool // ABIs to use (e.g. "common", "64", "x32"), all if empty
+}
+
+func makeTableOptions(compat bool, abis string) tableOptions {
+	opts := tableOptions{compat: compat}
+	if abis != "" {
+		opts.abis = make(map[string]bool)
+		for _, abi := range strings.Split(abis, ",") {
+			opts.abis[strings.TrimSpace(abi)] = true
+		}
+	}
+	return opts
+}
+
+// readSyscallNames returns syscall renames for each arch directory (e.g. "x86") under kernelDir/arch.
+func readSyscallNames(kernelDir string, opts tableOptions) map[string]map[string][]string {
+	kernelDir, err := filepath.EvalSymlinks(kernelDir)
+	if err != nil {
+		fail(err)
+	}
+	perArch := make(map[string]map[string][]string)
 	for _, arch := range targets.List[targets.Linux] {
-		filepath.Walk(filepath.Join(kernelDir, arch.KernelHeaderArch),
+		if perArch[arch.KernelHeaderArch] != nil {
+			continue // e.g. amd64 and 386 share the x86 directory
+		}
+		table := make(syscallTable)
+		visited := make(map[string]bool)
+		filepath.Walk(filepath.Join(kernelDir, "arch", arch.KernelHeaderArch),
 			func(path string, info fs.FileInfo, err error) error {
 				if !strings.HasSuffix(path, ".tbl") {
 					return nil
 				}
-				fi, fErr := os.Lstat(path)
-				if fErr != nil {
-					tool.Fail(err)
-				}
-				if fi.Mode()&fs.ModeSymlink != 0 { // Some symlinks link to files outside of arch directory.
+				// Some arches symlink to tables shared within the kernel tree, these are fine.
+				// But some symlinks link to files outside of the kernel tree, we skip these.
+				// EvalSymlinks fails on symlink loops.
+				target, err := filepath.EvalSymlinks(path)
+				if err != nil || !isSubpath(kernelDir, target) || visited[target] {
 					return nil
 				}
-				f, fErr := os.Open(path)
-				if fErr != nil {
-					tool.Fail(err)
-				}
-				s := bufio.NewScanner(f)
-				for s.Scan() {
-					fields := strings.Fields(s.Text())
-					if len(fields) < 4 || fields[0] == "#" || strings.HasPrefix(fields[2], "unused") || fields[3] == "-" ||
-						strings.HasPrefix(fields[3], "compat") || fields[3] == "sys_ni_syscall" {
-						continue
-					}
-					key := strings.TrimPrefix(fields[3], "sys_")
-					rename[key] = append(rename[key], fields[2])
+				visited[target] = true
+				f, err := os.Open(target)
+				if err != nil {
+					fail(err)
 				}
+				defer f.Close()
+				parseSyscallTable(f, table, opts.compat)
 				return nil
 			})
+		perArch[arch.KernelHeaderArch] = table.renames(opts.abis)
+	}
+	return perArch
+}
+
+// readCustomSyscallNames is like readSyscallNames, but reads tables matching the comma-separated
+// list of globs. It's useful for kernels that keep syscall tables outside of the arch directories.
+// The arch of each table is inferred from its path.
+func readCustomSyscallNames(tables string, opts tableOptions) (map[string]map[string][]string, error) {
+	perArch := make(map[string]syscallTable)
+	for _, pattern := range strings.Split(tables, ",") {
+		files, err := filepath.Glob(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no syscall tables match %v", pattern)
+		}
+		for _, file := range files {
+			arch := syscallTableArch(file)
+			if arch == "" {
+				return nil, fmt.Errorf("can't infer arch of syscall table %v", file)
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if perArch[arch] == nil {
+				perArch[arch] = make(syscallTable)
+			}
+			parseSyscallTable(bytes.NewReader(data), perArch[arch], opts.compat)
+		}
+	}
+	res := make(map[string]map[string][]string)
+	for arch, table := range perArch {
+		res[arch] = table.renames(opts.abis)
 	}
+	return res, nil
+}
 
+// syscallTableArch returns the kernel arch directory name (e.g. "x86") the syscall table belongs to.
+// The closest to the file path element that names an arch wins (e.g. "arch/arm64/tools/syscall.tbl"),
+// otherwise the file name is checked for an arch name (e.g. "syscall_x86.tbl").
+func syscallTableArch(file string) string {
+	archs := make(map[string]bool)
+	for _, arch := range targets.List[targets.Linux] {
+		archs[arch.KernelHeaderArch] = true
+	}
+	elems := strings.Split(filepath.ToSlash(filepath.Dir(file)), "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		if archs[elems[i]] {
+			return elems[i]
+		}
+	}
+	name := strings.TrimSuffix(filepath.Base(file), ".tbl")
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+		if archs[part] {
+			return part
+		}
+	}
+	return ""
+}
+
+func compactSyscallNames(rename map[string][]string) {
 	for k := range rename {
 		slices.Sort(rename[k])
 		rename[k] = slices.Compact(rename[k])
 	}
+}
+
+func isSubpath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
 
+// compatPrefix is the prefix of rename keys of compat syscalls, e.g. compat_sys_open is keyed as compat_open.
+const compatPrefix = "compat_"
+
+// syscallTable holds renames from entry points to syscall names separately for each ABI
+// (e.g. "common", "64", "x32"). The same entry point may be used by different syscalls in different ABIs,
+// so renames of ABIs that are not used must not leak into the result.
+type syscallTable map[string]map[string][]string
+
+func (table syscallTable) add(abi, key, name string) {
+	if table[abi] == nil {
+		table[abi] = make(map[string][]string)
+	}
+	table[abi][key] = append(table[abi][key], name)
+}
+
+// renames merges renames of the abis (all if empty).
+func (table syscallTable) renames(abis map[string]bool) map[string][]string {
+	rename := make(map[string][]string)
+	for abi, abiRename := range table {
+		if len(abis) != 0 && !abis[abi] {
+			continue
+		}
+		for k, names := range abiRename {
+			rename[k] = append(rename[k], names...)
+		}
+	}
+	compactSyscallNames(rename)
+	return rename
+}
+
+// parseSyscallTable records renames from entry points to syscall names found in the .tbl file.
+// Compat entry points (in the entry point column for e.g. x32 rows, or in the optional compat column)
+// are recorded only if compat is set.
+func parseSyscallTable(r io.Reader, table syscallTable, compat bool) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[0] == "#" || strings.HasPrefix(fields[2], "unused") || fields[3] == "-" {
+			continue
+		}
+		for i, entry := range fields[3:min(len(fields), 5)] {
+			var key string
+			switch {
+			case strings.HasPrefix(entry, "compat_sys_"):
+				if !compat {
+					continue
+				}
+				key = compatPrefix + strings.TrimPrefix(entry, "compat_sys_")
+			case strings.HasPrefix(entry, "compat") || entry == "sys_ni_syscall" || i != 0:
+				continue
+			default:
+				key = strings.TrimPrefix(entry, "sys_")
+			}
+			table.add(fields[1], key, fields[2])
+		}
+	}
+}
+
+// mergeSyscallNames combines per-arch renames into a single rename map.
+func mergeSyscallNames(perArch map[string]map[string][]string) map[string][]string {
+	rename := make(map[string][]string)
+	for _, archRename := range perArch {
+		for k, names := range archRename {
+			rename[k] = append(rename[k], names...)
+		}
+	}
+	compactSyscallNames(rename)
 	return rename
 }
 
-func isProhibited(syscall string) bool {
-	switch syscall {
-	case "reboot", "utimesat": // utimesat is not defined for all arches.
+// perArchFile returns the name of the output file for the arch, e.g. out_x86.txt for out.txt.
+func perArchFile(outFile, arch string) string {
+	ext := filepath.Ext(outFile)
+	return strings.TrimSuffix(outFile, ext) + "_" + arch + ext
+}
+
+// excludeList is a set of syscall names (as used in the syscall tables) that are never emitted.
+// Names are lower-case and may be glob patterns (e.g. "ptrace*" or "*_time64").
+type excludeList map[string]bool
+
+var defaultExcludes = []string{
+	"reboot",
+	"utimesat", // utimesat is not defined for all arches.
+}
+
+// makeExcludeList builds the exclude list from the -exclude flag value,
+// which is either a comma-separated list of syscall names, or a file with one name per line.
+func makeExcludeList(value string, noDefault bool) (excludeList, error) {
+	excluded := make(excludeList)
+	if !noDefault {
+		for _, name := range defaultExcludes {
+			excluded[name] = true
+		}
+	}
+	if value == "" {
+		return excluded, nil
+	}
+	names := strings.Split(value, ",")
+	if osutil.IsExist(value) {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+		names = strings.Split(string(data), "\n")
+	}
+	for _, name := range names {
+		name, _, _ = strings.Cut(name, "#")
+		if name = strings.TrimSpace(name); name != "" {
+			excluded[strings.ToLower(name)] = true
+		}
+	}
+	return excluded, nil
+}
+
+// isProhibited matches the syscall name against the list case-insensitively.
+func (excluded excludeList) isProhibited(syscall string) bool {
+	syscall = strings.ToLower(syscall)
+	if excluded[syscall] {
 		return true
-	default:
-		return false
 	}
+	for pattern := range excluded {
+		if strings.ContainsAny(pattern, "*?[") {
+			if match, _ := filepath.Match(pattern, syscall); match {
+				return true
+			}
+		}
+	}
+	return false
 }
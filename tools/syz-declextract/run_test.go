@@ -0,0 +1,1074 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerSkipsNonC(t *testing.T) {
+	binary := fakeExtractor(t, `echo "$3"`)
+	files := []string{"a.c", "b.h", "c.S", "d.c", "e.h", "f.c"}
+	outputs := make(chan output, len(files))
+	in := make(chan compileCommand, len(files))
+	for _, file := range files {
+		in <- compileCommand{File: file}
+	}
+	close(in)
+	worker(outputs, in, (&extractor{binary: binary, timeout: time.Minute}).run)
+	if len(outputs) != len(files) {
+		t.Fatalf("got %v outputs, want %v", len(outputs), len(files))
+	}
+	var compiled []string
+	for range files {
+		out := <-outputs
+		if out.stderr != "" {
+			t.Fatalf("unexpected stderr: %v", out.stderr)
+		}
+		if out.stdout != "" {
+			compiled = append(compiled, strings.TrimSpace(out.stdout))
+		}
+	}
+	slices.Sort(compiled)
+	if want := []string{"a.c", "d.c", "f.c"}; !slices.Equal(compiled, want) {
+		t.Fatalf("compiled %q, want %q", compiled, want)
+	}
+}
+
+func TestWorkersConcurrency(t *testing.T) {
+	for _, jobs := range []int{1, 3, 8} {
+		var mu sync.Mutex
+		running, peak := 0, 0
+		run := func(cmd compileCommand) output {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return output{file: cmd.File}
+		}
+		const files = 30
+		outputs := make(chan output, files)
+		in := make(chan compileCommand, files)
+		for i := 0; i < files; i++ {
+			in <- compileCommand{File: fmt.Sprintf("%v.c", i)}
+		}
+		close(in)
+		startWorkers(jobs, outputs, in, run)
+		for i := 0; i < files; i++ {
+			<-outputs
+		}
+		mu.Lock()
+		if peak > jobs || peak < 1 {
+			t.Errorf("jobs=%v: peak number of running workers is %v", jobs, peak)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestClampJobs(t *testing.T) {
+	for _, test := range []struct {
+		jobs, files, cpus, want int
+	}{
+		{jobs: 8, files: 100, cpus: 8, want: 8},
+		{jobs: 8, files: 3, cpus: 8, want: 3},
+		{jobs: 100000, files: 50000, cpus: 8, want: 32},
+		{jobs: 100000, files: 10, cpus: 8, want: 10},
+		{jobs: 2, files: 100, cpus: 1, want: 2},
+	} {
+		if got := clampJobs(test.jobs, test.files, test.cpus); got != test.want {
+			t.Errorf("clampJobs(%v, %v, %v) = %v, want %v", test.jobs, test.files, test.cpus, got, test.want)
+		}
+	}
+}
+
+func TestExtractAllNoDeadlock(t *testing.T) {
+	// Many more commands than channel capacity.
+	const files = 1000
+	var cmds []compileCommand
+	for i := 0; i < files; i++ {
+		cmds = append(cmds, compileCommand{File: fmt.Sprintf("%v.c", i)})
+	}
+	run := func(cmd compileCommand) output {
+		return output{file: cmd.File, stdout: cmd.File}
+	}
+	seen := make(map[string]bool)
+	done := make(chan bool)
+	go func() {
+		extractAll(cmds, 2, run, func(out output) {
+			seen[out.stdout] = true
+		}, nil, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		t.Fatalf("extractAll deadlocked")
+	}
+	if len(seen) != files {
+		t.Fatalf("got %v outputs, want %v", len(seen), files)
+	}
+}
+
+func TestExtractAllStop(t *testing.T) {
+	const files = 100
+	var cmds []compileCommand
+	for i := 0; i < files; i++ {
+		cmds = append(cmds, compileCommand{File: fmt.Sprintf("%v.c", i)})
+	}
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	started := 0
+	run := func(cmd compileCommand) output {
+		mu.Lock()
+		started++
+		if started == 10 {
+			close(stop)
+		}
+		mu.Unlock()
+		return output{file: cmd.File}
+	}
+	handled := 0
+	processed := extractAll(cmds, 3, run, func(out output) { handled++ }, stop, time.Minute)
+	mu.Lock()
+	defer mu.Unlock()
+	if processed != handled || processed != started {
+		t.Fatalf("processed %v, handled %v, started %v", processed, handled, started)
+	}
+	// A few files may have been dispatched concurrently with the stop.
+	if started < 10 || started > 10+3+1 {
+		t.Fatalf("started %v files after stop", started)
+	}
+}
+
+func TestExtractAllGracePeriod(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+	block := make(chan struct{})
+	defer close(block)
+	run := func(cmd compileCommand) output {
+		<-block
+		return output{file: cmd.File}
+	}
+	cmds := []compileCommand{{File: "a.c"}, {File: "b.c"}}
+	// The stop may race with the dispatch of the first file, which then never finishes.
+	processed := extractAll(cmds, 1, run, func(output) {}, stop, 100*time.Millisecond)
+	if processed != 0 {
+		t.Fatalf("processed %v files", processed)
+	}
+}
+
+func TestExtractorTimeout(t *testing.T) {
+	// The sleep is a child of the shell, so the whole process tree needs to be killed
+	// for the output pipes to be closed.
+	ex := &extractor{
+		binary:  fakeExtractor(t, "sleep 100"),
+		timeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	out := ex.extract("a.c")
+	if elapsed := time.Since(start); elapsed > 50*time.Second {
+		t.Fatalf("extractor was not killed on time: %v", elapsed)
+	}
+	if !strings.HasPrefix(out.stderr, "timed out") {
+		t.Fatalf("unexpected error: %q", out.stderr)
+	}
+}
+
+func TestExtractorFailure(t *testing.T) {
+	ex := &extractor{
+		binary:  fakeExtractor(t, "echo 'error: bad file' >&2; exit 1"),
+		timeout: time.Minute,
+	}
+	if out := ex.extract("a.c"); out.stderr != "error: bad file\n" {
+		t.Fatalf("unexpected error: %q", out.stderr)
+	}
+}
+
+func TestCheckBinary(t *testing.T) {
+	binary := fakeExtractor(t, "true")
+	if path, err := checkBinary(binary); err != nil || path != binary {
+		t.Errorf("got %q, %v for an executable binary", path, err)
+	}
+	notExecutable := filepath.Join(t.TempDir(), "syz-declextract")
+	writeFile(t, notExecutable, "#!/bin/sh\n")
+	for _, binary := range []string{notExecutable, filepath.Join(t.TempDir(), "missing"), "syz-declextract-missing"} {
+		if _, err := checkBinary(binary); err == nil {
+			t.Errorf("no error for %v", binary)
+		}
+	}
+	t.Setenv("PATH", filepath.Dir(binary))
+	if path, err := checkBinary(filepath.Base(binary)); err != nil || path != binary {
+		t.Errorf("got %q, %v for a binary in PATH", path, err)
+	}
+}
+
+func TestCleanups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		writeFile(t, filepath.Join(dir, name, "compile_commands.json"), fmt.Sprintf(`[
+	{"arguments": ["cc", "-c", "%[1]v.c"], "directory": %[2]q, "file": "%[1]v.c"}
+]`, name, dir))
+	}
+	// The merged database is saved to a temp dir that must be removed on all exit paths,
+	// including fatal errors that exit without running deferred calls.
+	dbFile, _, _ := loadCommands(filepath.Join(dir, "*", "compile_commands.json"), "")
+	if _, err := os.Stat(dbFile); err != nil {
+		t.Fatal(err)
+	}
+	var order []int
+	atExit(func() { order = append(order, 1) })
+	atExit(func() { order = append(order, 2) })
+	runCleanups()
+	if _, err := os.Stat(filepath.Dir(dbFile)); !os.IsNotExist(err) {
+		t.Errorf("temp database dir is not removed: %v", err)
+	}
+	if !slices.Equal(order, []int{2, 1}) {
+		t.Errorf("cleanups ran in order %v, want [2 1]", order)
+	}
+	runCleanups()
+	if len(order) != 2 {
+		t.Errorf("cleanups ran more than once: %v", order)
+	}
+}
+
+func TestErrorSummary(t *testing.T) {
+	failed := []output{
+		{file: "fs/b.c", stderr: "error: b\n"},
+		{file: "fs/a.c", stderr: "error: a\n"},
+		{file: "mm/c.c", stderr: "error: c"},
+	}
+	want := `3/10 files failed:
+fs/a.c: error: a
+fs/b.c: error: b
+mm/c.c: error: c
+`
+	if got := errorSummary(failed, 10); got != want {
+		t.Fatalf("got summary:\n%v\nwant:\n%v", got, want)
+	}
+	if failed[0].file != "fs/b.c" {
+		t.Fatalf("errorSummary modified its argument")
+	}
+}
+
+func TestFormatOutput(t *testing.T) {
+	out := formatOutput(nil, []string{
+		"ioctl$B(fd intptr, cmd intptr, arg intptr) (automatic)",
+		"read$auto(fd intptr, buf intptr, count intptr) (automatic)",
+		"ioctl$A(fd intptr, cmd intptr, arg intptr) (automatic)",
+		"ioctl$A(fd intptr, cmd intptr, arg intptr) (automatic)",
+		"ioctl$A(fd intptr, cmd intptr, arg2 intptr) (automatic)",
+	})
+	want := `# Code generated by syz-declextract. DO NOT EDIT.
+ioctl$A(fd intptr, cmd intptr, arg intptr) (automatic)
+ioctl$B(fd intptr, cmd intptr, arg intptr) (automatic)
+read$auto(fd intptr, buf intptr, count intptr) (automatic)
+_ = __NR_mmap2
+`
+	if string(out) != want {
+		t.Fatalf("got output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestWriteOutputStdout(t *testing.T) {
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	oldStdout := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = oldStdout }()
+
+	data := formatOutput(nil, []string{"read$auto(fd intptr) (automatic)"})
+	writeOutput(data, "-")
+	got, err := os.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) || !strings.HasPrefix(string(got), "# Code generated by syz-declextract") {
+		t.Fatalf("got stdout:\n%s\nwant:\n%s", got, data)
+	}
+}
+
+func TestCompareDescriptions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"read$auto(fd intptr) (automatic)", "write$auto(fd fd) (automatic)", -1},
+		// More resolved argument types win regardless of the lexical order.
+		{"ioctl$A(fd intptr, arg ptr[in, int32]) (automatic)", "ioctl$A(fd intptr, arg intptr) (automatic)", -1},
+		{"ioctl$A(fd intptr, arg intptr) (automatic)", "ioctl$A(fd fd, arg ptr[in, int32]) (automatic)", 1},
+		// Same number of resolved types, lexical order.
+		{"ioctl$A(a intptr) (automatic)", "ioctl$A(b intptr) (automatic)", -1},
+		{"ioctl$A(a intptr) (automatic)", "ioctl$A(a intptr) (automatic)", 0},
+	} {
+		if got := compareDescriptions(test.a, test.b); got != test.want {
+			t.Errorf("compare(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+		if got := compareDescriptions(test.b, test.a); got != -test.want {
+			t.Errorf("compare(%q, %q) = %v, want %v", test.b, test.a, got, -test.want)
+		}
+	}
+	out := formatOutput(nil, []string{
+		"ioctl$A(fd intptr, arg intptr) (automatic)",
+		"ioctl$A(fd intptr, arg ptr[in, int32]) (automatic)",
+		"ioctl$A(fd intptr, arg2 intptr) (automatic)",
+	})
+	if !strings.Contains(string(out), "\nioctl$A(fd intptr, arg ptr[in, int32]) (automatic)\n") {
+		t.Fatalf("the most resolved description is not chosen:\n%s", out)
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	good := formatOutput(nil, []string{
+		"read$auto(fd intptr, buf intptr, count intptr) (automatic)",
+		"sync$auto() (automatic)",
+	})
+	if err := validateOutput(good, nil); err != nil {
+		t.Fatalf("valid output failed validation: %v", err)
+	}
+	bad := formatOutput(nil, []string{
+		"read$auto(fd intptr, buf intptr, count intptr) (automatic)",
+		"write$auto(fd intptr, buf foobar) (automatic)",
+	})
+	err := validateOutput(bad, map[string]string{"write$auto": "fs/read_write.c"})
+	if err == nil {
+		t.Fatalf("invalid output passed validation")
+	}
+	if !strings.Contains(err.Error(), "fs/read_write.c: output.txt:3:") {
+		t.Fatalf("error does not mention the source file: %v", err)
+	}
+	if err := validateOutput([]byte("read$auto(fd intptr"), nil); err == nil {
+		t.Fatalf("syntax error passed validation")
+	}
+}
+
+func TestResultsIoctls(t *testing.T) {
+	res := &results{
+		syscallNames: map[string][]string{"ioctl": {"ioctl"}},
+		archOut:      make(map[string][]string),
+		origins:      make(map[string]string),
+	}
+	getflags := "ioctl$FS_IOC_GETFLAGS(fd intptr, cmd const[FS_IOC_GETFLAGS], arg ptr[out, int64]) (automatic)"
+	res.add(output{file: "fs/ioctl.c", stdout: strings.Join([]string{
+		getflags,
+		"ioctl$FIFREEZE(fd intptr, cmd const[FIFREEZE]) (automatic)",
+		"ioctl$FS_IOC_GETFSLABEL(fd intptr, cmd const[FS_IOC_GETFSLABEL], " +
+			"arg ptr[out, array[int8, 256]]) (automatic) # TODO: describe char[256]",
+	}, "\n")})
+	res.add(output{file: "fs/ext4/ioctl.c", stdout: getflags})
+	out := formatOutput(nil, res.allOut)
+	if got := strings.Count(string(out), "ioctl$"); got != 3 {
+		t.Fatalf("got %v ioctls, want 3:\n%s", got, out)
+	}
+	if err := validateOutput(out, res.origins); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "# TODO: describe char[256]\nioctl$FS_IOC_GETFSLABEL(") {
+		t.Fatalf("TODO comment is not on a separate line:\n%s", out)
+	}
+	name, args := parseDescription(res.allOut[2])
+	if name != "ioctl" || len(args) != 3 || args[2].Type != "ptr[out, array[int8, 256]]" {
+		t.Fatalf("bad parsed description: %v %+v", name, args)
+	}
+}
+
+func TestRenameReport(t *testing.T) {
+	res := &results{
+		syscallNames: map[string][]string{
+			"open":     {"open"},
+			"setuid16": {"setuid"},
+			"setuid":   {"setuid32"},
+			"close":    {"close"},
+			"ioctl":    {"ioctl"},
+		},
+		excluded:     excludeList{"close": true},
+		renameReport: true,
+		archOut:      make(map[string][]string),
+		origins:      make(map[string]string),
+		matched:      make(map[string]bool),
+		dropped:      make(map[string]bool),
+	}
+	res.add(output{file: "fs/open.c", stdout: `open$auto(file intptr) (automatic)
+close$auto(fd intptr) (automatic)
+openat2$auto(fd intptr) (automatic)
+`})
+	res.add(output{file: "kernel/sys.c", stdout: `setuid16$auto(uid intptr) (automatic)
+getuid16$auto() (automatic)
+openat2$auto(fd intptr) (automatic)
+`})
+	want := `# 2 extracted syscalls without syscall table entries:
+getuid16
+openat2
+
+# 2 syscall table entries without extracted syscalls:
+ioctl
+setuid
+`
+	if got := string(formatRenameReport(res.syscallNames, res.matched, res.dropped)); got != want {
+		t.Fatalf("got report:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestResultsDeclarations(t *testing.T) {
+	res := &results{
+		syscallNames: map[string][]string{"open": {"open"}, "close": {"close"}},
+		types:        true,
+		decls:        make(declarations),
+		archOut:      make(map[string][]string),
+		origins:      make(map[string]string),
+	}
+	res.add(output{file: "fs/open.c", stdout: `resource fd_auto[int32]
+type flags_auto int32
+open$auto(file ptr[in, filename], flags flags_auto) fd_auto (automatic)
+`})
+	res.add(output{file: "fs/close.c", stdout: `resource fd_auto[int32]
+type flags_auto int64
+close$auto(fd fd_auto) (automatic)
+`})
+	if len(res.failed) != 1 || res.failed[0].file != "fs/close.c" ||
+		!strings.Contains(res.failed[0].stderr, "conflicting declarations of flags_auto") {
+		t.Fatalf("unexpected errors: %+v", res.failed)
+	}
+	got := string(formatOutput(res.decls.sorted(), res.allOut))
+	want := `# Code generated by syz-declextract. DO NOT EDIT.
+resource fd_auto[int32]
+type flags_auto int32
+
+close$auto(fd fd_auto) (automatic)
+open$auto(file ptr[in, filename], flags flags_auto) fd_auto (automatic)
+_ = __NR_mmap2
+`
+	if got != want {
+		t.Fatalf("got output:\n%v\nwant:\n%v", got, want)
+	}
+	if err := validateOutput([]byte(got), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTypes(t *testing.T) {
+	// The binary emits struct declarations only with -types (see IoctlPrinter in syz-declextract.cpp).
+	ex := &extractor{
+		binary: fakeExtractor(t, `if [ "$4" = -types ]; then
+	echo 'type fsxattr_auto array[int8, 28] # TODO: describe struct fsxattr'
+	echo 'ioctl$FS_IOC_FSGETXATTR(fd intptr, cmd const[FS_IOC_FSGETXATTR], arg ptr[out, fsxattr_auto]) (automatic)'
+else
+	echo 'ioctl$FS_IOC_FSGETXATTR(fd intptr, cmd const[FS_IOC_FSGETXATTR], arg ptr[out, array[int8, 28]]) ' \
+		'(automatic) # TODO: describe struct fsxattr'
+fi`),
+		timeout: time.Minute,
+	}
+	extract := func(types bool) string {
+		ex.types = types
+		res := &results{
+			syscallNames: map[string][]string{"ioctl": {"ioctl"}},
+			types:        types,
+			decls:        make(declarations),
+			origins:      make(map[string]string),
+		}
+		res.add(ex.extract("fs/ioctl.c"))
+		if len(res.failed) != 0 {
+			t.Fatalf("unexpected errors: %+v", res.failed)
+		}
+		return string(formatOutput(res.decls.sorted(), res.allOut))
+	}
+	got := extract(true)
+	if !strings.Contains(got, "type fsxattr_auto array[int8, 28] # TODO: describe struct fsxattr\n\n") ||
+		!strings.Contains(got, "arg ptr[out, fsxattr_auto]) (automatic)") {
+		t.Fatalf("no type declaration in the output:\n%v", got)
+	}
+	if got := extract(false); strings.Contains(got, "fsxattr_auto") {
+		t.Fatalf("type declaration without -types:\n%v", got)
+	}
+}
+
+func TestParseDescription(t *testing.T) {
+	tests := []struct {
+		desc string
+		name string
+		args []argInfo
+	}{
+		{
+			desc: "read$auto(fd intptr, buf intptr, count intptr) (automatic)",
+			name: "read",
+			args: []argInfo{{"fd", "intptr"}, {"buf", "intptr"}, {"count", "intptr"}},
+		},
+		{
+			desc: "sync$auto() (automatic)",
+			name: "sync",
+		},
+		{
+			desc: "foo(a ptr[in, array[int8]], b flags[bar, int32])",
+			name: "foo",
+			args: []argInfo{{"a", "ptr[in, array[int8]]"}, {"b", "flags[bar, int32]"}},
+		},
+	}
+	for _, test := range tests {
+		name, args := parseDescription(test.desc)
+		if name != test.name || !slices.Equal(args, test.args) {
+			t.Errorf("%q: got %v %v, want %v %v", test.desc, name, args, test.name, test.args)
+		}
+	}
+}
+
+func TestMakeSyscallInfo(t *testing.T) {
+	rename := map[string][]string{
+		"setuid16": {"setuid", "setuid32"},
+	}
+	info := makeSyscallInfo("kernel/uid16.c", "setuid16$auto(uid intptr) (automatic)", rename, nil)
+	want := &syscallInfo{
+		File:  "kernel/uid16.c",
+		Name:  "setuid16",
+		Names: []string{"setuid", "setuid32"},
+		Args:  []argInfo{{"uid", "intptr"}},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("got %+v, want %+v", info, want)
+	}
+}
+
+func TestExcludeList(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "exclude.txt")
+	writeFile(t, file, "# comment\nptrace\n\n  kexec_load # trailing comment\n")
+	tests := []struct {
+		value     string
+		noDefault bool
+		excluded  []string
+		allowed   []string
+	}{
+		{
+			value:    "",
+			excluded: []string{"reboot", "utimesat"},
+			allowed:  []string{"read", "reboot2"},
+		},
+		{
+			value:    "ptrace,kexec_load",
+			excluded: []string{"reboot", "utimesat", "ptrace", "kexec_load"},
+			allowed:  []string{"read", "ptrace2"},
+		},
+		{
+			value:     "ptrace, kexec_load",
+			noDefault: true,
+			excluded:  []string{"ptrace", "kexec_load"},
+			allowed:   []string{"reboot", "utimesat"},
+		},
+		{
+			value:    file,
+			excluded: []string{"reboot", "ptrace", "kexec_load"},
+			allowed:  []string{"read", "comment", "#"},
+		},
+		{
+			value:     file,
+			noDefault: true,
+			excluded:  []string{"ptrace", "kexec_load"},
+			allowed:   []string{"reboot"},
+		},
+		{
+			value:     "PTrace,Kexec_Load",
+			noDefault: true,
+			excluded:  []string{"ptrace", "PTRACE", "kexec_load", "KEXEC_LOAD"},
+			allowed:   []string{"ptrace2"},
+		},
+		{
+			value:     "ptrace*,*_TIME64",
+			noDefault: true,
+			excluded:  []string{"ptrace", "ptrace2", "PTRACE_foo", "clock_gettime_time64", "FOO_time64"},
+			allowed:   []string{"strace", "time64", "clock_gettime64", "sys_ptrace"},
+		},
+	}
+	for i, test := range tests {
+		excluded, err := makeExcludeList(test.value, test.noDefault)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range test.excluded {
+			if !excluded.isProhibited(name) {
+				t.Errorf("test #%v: %v is not excluded", i, name)
+			}
+		}
+		for _, name := range test.allowed {
+			if excluded.isProhibited(name) {
+				t.Errorf("test #%v: %v is excluded", i, name)
+			}
+		}
+	}
+}
+
+func TestRenameSyscallExcluded(t *testing.T) {
+	rename := map[string][]string{
+		"setuid16": {"setuid", "setuid32"},
+	}
+	excluded := excludeList{"setuid": true}
+	got := renameSyscall("setuid16$auto(uid intptr) (automatic)", rename, excluded)
+	if want := []string{"setuid32$auto(uid intptr) (automatic)"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRenameSyscallVariant(t *testing.T) {
+	rename := map[string][]string{
+		"fcntl":          {"fcntl64"},
+		"compat_sys_foo": {"foo"},
+	}
+	for desc, want := range map[string]string{
+		"fcntl$fcntl(fcntl fd, cmd intptr)":   "fcntl64$fcntl(fcntl fd, cmd intptr)",
+		"fcntl$auto_fcntl(fd fd)":             "fcntl64$auto_fcntl(fd fd)",
+		"compat_sys_foo$compat_sys_foo(a fd)": "foo$compat_sys_foo_compat(a fd)",
+		"compat_sys_foo(compat_sys_foo fd)":   "foo$compat(compat_sys_foo fd)",
+	} {
+		got := renameSyscall(desc, rename, nil)
+		if want := []string{want}; !slices.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", desc, got, want)
+		}
+	}
+}
+
+func TestParseSyscallTableCompat(t *testing.T) {
+	const table = `
+0	i386	restart_syscall		sys_restart_syscall
+5	i386	open			sys_open			compat_sys_open
+13	i386	time			sys_time32
+512	x32	rt_sigaction		compat_sys_rt_sigaction
+513	x32	rt_sigreturn		compat_sys_x32_rt_sigreturn
+514	x32	ioctl			sys_ioctl
+515	x32	unused515		compat_sys_unused
+516	x32	ni			sys_ni_syscall
+`
+	native := map[string][]string{
+		"restart_syscall": {"restart_syscall"},
+		"open":            {"open"},
+		"time32":          {"time"},
+		"ioctl":           {"ioctl"},
+	}
+	parsed := make(syscallTable)
+	parseSyscallTable(strings.NewReader(table), parsed, false)
+	rename := parsed.renames(nil)
+	if !reflect.DeepEqual(rename, native) {
+		t.Errorf("without compat: got %v, want %v", rename, native)
+	}
+	parsed = make(syscallTable)
+	parseSyscallTable(strings.NewReader(table), parsed, true)
+	rename = parsed.renames(nil)
+	want := map[string][]string{
+		"compat_open":             {"open"},
+		"compat_rt_sigaction":     {"rt_sigaction"},
+		"compat_x32_rt_sigreturn": {"rt_sigreturn"},
+	}
+	for k, v := range native {
+		want[k] = v
+	}
+	if !reflect.DeepEqual(rename, want) {
+		t.Errorf("with compat: got %v, want %v", rename, want)
+	}
+	var got []string
+	for _, desc := range []string{
+		"compat_open$auto(file ptr[in, filename]) (automatic)",
+		"open$auto(file ptr[in, filename]) (automatic)",
+		"compat_rt_sigaction$auto(sig intptr) (automatic)",
+	} {
+		got = append(got, renameSyscall(desc, rename, nil)...)
+	}
+	wantDescs := []string{
+		"open$auto_compat(file ptr[in, filename]) fd (automatic)",
+		"open$auto(file ptr[in, filename]) fd (automatic)",
+		"rt_sigaction$auto_compat(sig intptr) (automatic)",
+	}
+	if !slices.Equal(got, wantDescs) {
+		t.Errorf("got descriptions %q, want %q", got, wantDescs)
+	}
+}
+
+func TestSyscallTableABIs(t *testing.T) {
+	// The same entry point is used by different syscalls in the 64 and x32 ABIs.
+	const table = `
+0	common	read			sys_read
+1	64	foo			sys_foo
+2	x32	bar			sys_foo
+3	x32	baz			sys_baz
+`
+	parsed := make(syscallTable)
+	parseSyscallTable(strings.NewReader(table), parsed, false)
+	for _, test := range []struct {
+		abis string
+		want map[string][]string
+	}{
+		{
+			abis: "",
+			want: map[string][]string{"read": {"read"}, "foo": {"bar", "foo"}, "baz": {"baz"}},
+		},
+		{
+			abis: "common,64",
+			want: map[string][]string{"read": {"read"}, "foo": {"foo"}},
+		},
+		{
+			abis: "x32",
+			want: map[string][]string{"foo": {"bar"}, "baz": {"baz"}},
+		},
+	} {
+		got := parsed.renames(makeTableOptions(false, test.abis).abis)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("abis %q: got %v, want %v", test.abis, got, test.want)
+		}
+	}
+}
+
+func TestReadSyscallNamesPerArch(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "arch", "x86", "entry", "syscalls", "syscall_64.tbl"), `
+# comment
+0	common	read			sys_read
+1	common	write			sys_write
+105	common	setuid			sys_setuid
+`)
+	writeFile(t, filepath.Join(dir, "arch", "arm", "tools", "syscall.tbl"), `
+3	common	read			sys_read
+4	common	write			sys_write
+23	common	setuid			sys_setuid16
+213	common	setuid32		sys_setuid
+`)
+	perArch := readSyscallNames(dir, tableOptions{})
+	wantX86 := map[string][]string{
+		"read":   {"read"},
+		"write":  {"write"},
+		"setuid": {"setuid"},
+	}
+	wantArm := map[string][]string{
+		"read":     {"read"},
+		"write":    {"write"},
+		"setuid16": {"setuid"},
+		"setuid":   {"setuid32"},
+	}
+	if !reflect.DeepEqual(perArch["x86"], wantX86) {
+		t.Errorf("x86: got %v, want %v", perArch["x86"], wantX86)
+	}
+	if !reflect.DeepEqual(perArch["arm"], wantArm) {
+		t.Errorf("arm: got %v, want %v", perArch["arm"], wantArm)
+	}
+	if len(perArch["arm64"]) != 0 {
+		t.Errorf("arm64: got %v, want nothing", perArch["arm64"])
+	}
+	merged := mergeSyscallNames(perArch)
+	wantMerged := map[string][]string{
+		"read":     {"read"},
+		"write":    {"write"},
+		"setuid16": {"setuid"},
+		"setuid":   {"setuid", "setuid32"},
+	}
+	if !reflect.DeepEqual(merged, wantMerged) {
+		t.Errorf("merged: got %v, want %v", merged, wantMerged)
+	}
+}
+
+func TestReadCustomSyscallNames(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "tables", "x86", "syscall_64.tbl"), `
+0	common	read			sys_read
+105	common	setuid			sys_setuid
+`)
+	writeFile(t, filepath.Join(dir, "tables", "syscall_arm64.tbl"), "1	common	write		sys_write\n")
+	writeFile(t, filepath.Join(dir, "other", "riscv-syscalls.tbl"), "2	common	close		sys_close\n")
+	perArch, err := readCustomSyscallNames(filepath.Join(dir, "tables", "*", "*.tbl")+","+
+		filepath.Join(dir, "tables", "*.tbl")+","+filepath.Join(dir, "other", "riscv-syscalls.tbl"), tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string][]string{
+		"x86":   {"read": {"read"}, "setuid": {"setuid"}},
+		"arm64": {"write": {"write"}},
+		"riscv": {"close": {"close"}},
+	}
+	if !reflect.DeepEqual(perArch, want) {
+		t.Fatalf("got %v, want %v", perArch, want)
+	}
+
+	writeFile(t, filepath.Join(dir, "unknown", "syscall.tbl"), "1	common	write		sys_write\n")
+	if _, err := readCustomSyscallNames(filepath.Join(dir, "unknown", "syscall.tbl"), tableOptions{}); err == nil {
+		t.Errorf("no error for a table of unknown arch")
+	}
+	if _, err := readCustomSyscallNames(filepath.Join(dir, "nothing", "*.tbl"), tableOptions{}); err == nil {
+		t.Errorf("no error for a pattern that matches nothing")
+	}
+}
+
+func TestSyscallTableArch(t *testing.T) {
+	for file, want := range map[string]string{
+		"arch/x86/entry/syscalls/syscall_64.tbl": "x86",
+		"arch/arm64/tools/syscall_32.tbl":        "arm64",
+		"/x86/build/arch/arm/tools/syscall.tbl":  "arm",
+		"tables/syscall_powerpc.tbl":             "powerpc",
+		"tables/mips-n64.tbl":                    "mips",
+		"tables/syscall.tbl":                     "",
+	} {
+		if got := syscallTableArch(file); got != want {
+			t.Errorf("%v: got %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestReadSyscallNamesSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(outside, "syscall.tbl"), "1	common	outside		sys_outside\n")
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "scripts", "syscall.tbl"), "1	common	shared		sys_shared\n")
+	archDir := filepath.Join(dir, "arch", "arm64")
+	writeFile(t, filepath.Join(archDir, "syscall.tbl"), "1	common	own		sys_own\n")
+	for link, target := range map[string]string{
+		"shared.tbl":  filepath.Join(dir, "scripts", "syscall.tbl"),
+		"outside.tbl": filepath.Join(outside, "syscall.tbl"),
+		"loop1.tbl":   filepath.Join(archDir, "loop2.tbl"),
+		"loop2.tbl":   filepath.Join(archDir, "loop1.tbl"),
+	} {
+		if err := os.Symlink(target, filepath.Join(archDir, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+	got := readSyscallNames(dir, tableOptions{})["arm64"]
+	want := map[string][]string{
+		"own":    {"own"},
+		"shared": {"shared"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestIsSubpath(t *testing.T) {
+	for _, test := range []struct {
+		path string
+		want bool
+	}{
+		{"/linux/arch/x86/syscall.tbl", true},
+		{"/linux", true},
+		{"/linux2/syscall.tbl", false},
+		{"/syscall.tbl", false},
+		{"/linux/../..foo", false},
+	} {
+		if got := isSubpath("/linux", test.path); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestPerArchFile(t *testing.T) {
+	if got := perArchFile(filepath.Join("dir", "out.txt"), "x86"); got != filepath.Join("dir", "out_x86.txt") {
+		t.Errorf("got %v", got)
+	}
+	if got := perArchFile("out", "arm"); got != "out_arm" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func writeFile(t *testing.T, file, data string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeExtractor creates a shell script that mimics the extractor binary.
+// The script receives the same arguments as the real one: -p database file.
+func fakeExtractor(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	binary := filepath.Join(t.TempDir(), "syz-declextract")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func TestResultsLocations(t *testing.T) {
+	res := &results{
+		syscallNames: map[string][]string{"setuid16": {"setuid"}, "ioctl": {"ioctl"}, "close": {"close"}},
+		json:         true,
+		locations:    true,
+		kernelDir:    "/linux",
+		archOut:      make(map[string][]string),
+		origins:      make(map[string]string),
+		sourceLines:  make(map[string]string),
+	}
+	res.add(output{file: "kernel/uid16.c", stdout: `# location: /linux/kernel/uid16.c:50
+setuid16$auto(uid intptr) (automatic)
+# location: /linux/include/linux/fs.h:10
+ioctl$FOO(fd intptr, cmd const[FOO], arg ptr[in, array[int8, 8]]) (automatic) # TODO: describe struct foo
+close$auto(fd intptr) (automatic)
+`})
+	// A worse description of the same syscall from another file loses dedup along with its location.
+	res.add(output{file: "fs/ext4/ioctl.c", stdout: `# location: /linux/fs/ext4/ioctl.c:1200
+ioctl$FOO(fd intptr, cmd intptr, arg intptr) (automatic)
+`})
+	outputs := res.formatOutputs("out.txt", true, false)
+	want := `# Code generated by syz-declextract. DO NOT EDIT.
+close$auto(fd intptr) (automatic)
+# TODO: describe struct foo
+# source: include/linux/fs.h:10
+ioctl$FOO(fd intptr, cmd const[FOO], arg ptr[in, array[int8, 8]]) (automatic)
+# source: kernel/uid16.c:50
+setuid$auto(uid intptr) (automatic)
+_ = __NR_mmap2
+`
+	if got := string(outputs["out.txt"]); got != want {
+		t.Fatalf("got output:\n%v\nwant:\n%v", got, want)
+	}
+	var locations []string
+	for _, info := range res.syscalls {
+		locations = append(locations, info.Location)
+	}
+	if want := []string{"kernel/uid16.c:50", "include/linux/fs.h:10", "", "fs/ext4/ioctl.c:1200"}; !reflect.DeepEqual(
+		locations, want) {
+		t.Fatalf("got JSON locations %q, want %q", locations, want)
+	}
+	// Without the flag the locations are not emitted.
+	res.locations = false
+	if got := string(res.formatOutputs("out.txt", false, false)["out.txt"]); strings.Contains(got, ".c:") {
+		t.Fatalf("locations are emitted:\n%v", got)
+	}
+}
+
+func TestCheckDescriptionCount(t *testing.T) {
+	descs := []string{
+		"open$auto(file intptr) (automatic)",
+		"open$auto(file ptr[in, filename]) (automatic)",
+		"close$auto(fd intptr) (automatic)",
+	}
+	for _, minCount := range []int{0, 1, 2} {
+		if err := checkDescriptionCount(descs, minCount); err != nil {
+			t.Fatalf("min %v: %v", minCount, err)
+		}
+	}
+	err := checkDescriptionCount(descs, 3)
+	if err == nil || !strings.Contains(err.Error(), "extracted 2 descriptions, expected at least 3") {
+		t.Fatalf("got error %v", err)
+	}
+	if err := checkDescriptionCount(nil, 1); err == nil {
+		t.Fatalf("no error for empty output")
+	}
+}
+
+func TestResultsNoArgs(t *testing.T) {
+	res := &results{
+		syscallNames: map[string][]string{
+			"sync":                {"sync"},
+			"sched_yield":         {"sched_yield"},
+			"vhangup":             {"vhangup"},
+			"compat_sys_vhangup":  {"vhangup"},
+			"compat_sched_yield2": {"sched_yield2"},
+		},
+		archOut: make(map[string][]string),
+		origins: make(map[string]string),
+	}
+	// SYSCALL_DEFINE0 syscalls, with and without a variant.
+	res.add(output{file: "fs/sync.c", stdout: "sync$auto() (automatic)\nvhangup()\n"})
+	res.add(output{file: "kernel/sched/core.c", stdout: "sched_yield$auto() (automatic)\ncompat_sched_yield2()\n"})
+	res.add(output{file: "fs/open.c", stdout: "compat_sys_vhangup$auto()\nmalformed"})
+	got := string(formatOutput(nil, res.allOut))
+	want := `# Code generated by syz-declextract. DO NOT EDIT.
+sched_yield$auto() (automatic)
+sched_yield2$compat()
+sync$auto() (automatic)
+vhangup()
+vhangup$auto_compat()
+_ = __NR_mmap2
+`
+	if got != want {
+		t.Fatalf("got output:\n%v\nwant:\n%v", got, want)
+	}
+	if err := validateOutput([]byte(got), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ desc, key string }{
+		{"sync$auto() (automatic)", "sync"},
+		{"vhangup()", "vhangup"},
+		{"vhangup", "vhangup"},
+	} {
+		if got := renameKey(test.desc); got != test.key {
+			t.Errorf("renameKey(%q) = %q, want %q", test.desc, got, test.key)
+		}
+	}
+}
+
+func TestExtractRetries(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	extract := func(script string, retries int) (output, int) {
+		os.Remove(counter)
+		ex := &extractor{
+			binary:  fakeExtractor(t, `echo run >> `+counter+"\n"+script),
+			timeout: time.Minute,
+			retries: retries,
+			backoff: time.Millisecond,
+		}
+		out := ex.extract("a.c")
+		data, _ := os.ReadFile(counter)
+		return out, strings.Count(string(data), "run")
+	}
+	// Killed by a signal once, then succeeds.
+	flaky := `if [ $(wc -l < ` + counter + `) -eq 1 ]; then kill -9 $$; fi; echo 'sync$auto()'`
+	if out, runs := extract(flaky, 2); out.stderr != "" || out.stdout != "sync$auto()\n" || runs != 2 {
+		t.Fatalf("flaky: got %+v after %v runs", out, runs)
+	}
+	if out, runs := extract(flaky, 0); out.stderr == "" || runs != 1 {
+		t.Fatalf("flaky without retries: got %+v after %v runs", out, runs)
+	}
+	// Always killed, reported after all retries.
+	if out, runs := extract(`kill -9 $$`, 2); out.stderr == "" || runs != 3 {
+		t.Fatalf("killed: got %+v after %v runs", out, runs)
+	}
+	// Compilation errors are not retried.
+	out, runs := extract(`echo "error: unknown type" >&2; exit 1`, 2)
+	if out.stderr != "error: unknown type\n" || runs != 1 {
+		t.Fatalf("compile error: got %+v after %v runs", out, runs)
+	}
+}
+
+func TestCoverageReport(t *testing.T) {
+	res := &results{
+		syscallNames: map[string][]string{
+			"open":     {"open"},
+			"setuid16": {"setuid"},
+			"setuid":   {"setuid32"},
+			"close":    {"close"},
+			"ioctl":    {"ioctl"},
+			"kexec":    {"kexec_load"},
+		},
+		excluded: excludeList{"kexec_load": true},
+		archOut:  make(map[string][]string),
+		origins:  make(map[string]string),
+	}
+	res.add(output{file: "fs/open.c", stdout: `open$auto(file intptr) (automatic)
+close$auto(fd intptr) (automatic)
+setuid16$auto(uid intptr) (automatic)
+ioctl$FOO(fd intptr, cmd const[FOO]) (automatic)
+`})
+	report, percent := formatCoverageReport(res.syscallNames, res.allOut, res.excluded)
+	want := `# extracted descriptions for 4/5 syscalls (80.0%)
+
+# 1 syscalls without descriptions:
+setuid32
+`
+	if string(report) != want || percent != 80 {
+		t.Fatalf("got %v%% report:\n%s\nwant:\n%v", percent, report, want)
+	}
+	if _, percent := formatCoverageReport(nil, nil, nil); percent != 100 {
+		t.Fatalf("got %v%% for no syscalls", percent)
+	}
+}
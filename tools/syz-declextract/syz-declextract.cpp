@@ -11,6 +11,8 @@
 #include "clang/ASTMatchers/ASTMatchers.h"
 #include "clang/ASTMatchers/ASTMatchersInternal.h"
 #include "clang/Basic/LLVM.h"
+#include "clang/Basic/SourceManager.h"
+#include "clang/Lex/Lexer.h"
 #include "clang/Sema/Ownership.h"
 #include "clang/Tooling/CommonOptionsParser.h"
 #include "clang/Tooling/Tooling.h"
@@ -25,6 +27,20 @@
 using namespace clang;
 using namespace clang::ast_matchers;
 
+static llvm::cl::OptionCategory SyzDeclExtractOptionCategory("SyzDeclExtract options");
+static llvm::cl::opt<bool> EmitTypes("types",
+                                     llvm::cl::desc("Emit shared type declarations for named struct arguments "
+                                                    "instead of inline buffers"),
+                                     llvm::cl::cat(SyzDeclExtractOptionCategory));
+
+// printLocation prints the source location of the following description, e.g. "# location: fs/open.c:1396".
+// For locations inside of macros (SYSCALL_DEFINE, _IOR) the location where the macro is used is printed.
+static void printLocation(const SourceManager &sm, SourceLocation loc) {
+  const PresumedLoc presumed = sm.getPresumedLoc(sm.getExpansionLoc(loc));
+  if (presumed.isValid())
+    printf("# location: %s:%u\n", presumed.getFilename(), presumed.getLine());
+}
+
 struct Param {
   std::string type;
   std::string name;
@@ -74,6 +90,7 @@ public:
       }
     }
 
+    printLocation(*Result.SourceManager, varDecl->getBeginLoc());
     printf("%s$auto(", values[0]->tryEvaluateString(*context).value().c_str() + 4); // name
     const char *sep = "";
     for (const auto &arg : args) {
@@ -84,8 +101,82 @@ public:
   }
 };
 
+// IoctlPrinter prints descriptions of ioctl commands defined with _IO/_IOR/_IOW/_IOWR macros
+// and used in case labels of ioctl handlers, e.g. "case FS_IOC_GETFLAGS:".
+class IoctlPrinter : public MatchFinder::MatchCallback {
+private:
+  const char *dir; // direction of the argument, or nullptr for _IO commands without an argument
+
+  static const UnaryExprOrTypeTraitExpr *findSizeof(const Stmt *stmt) {
+    if (const auto *expr = llvm::dyn_cast<UnaryExprOrTypeTraitExpr>(stmt))
+      if (expr->getKind() == UETT_SizeOf)
+        return expr;
+    for (const Stmt *child : stmt->children())
+      if (child)
+        if (const auto *res = findSizeof(child))
+          return res;
+    return nullptr;
+  }
+
+public:
+  IoctlPrinter(const char *dir) : dir(dir) {}
+
+  virtual void run(const MatchFinder::MatchResult &Result) override {
+    const auto *cmd = Result.Nodes.getNodeAs<Expr>("Cmd");
+    auto *context = Result.Context;
+    const SourceManager &sm = *Result.SourceManager;
+    if (!cmd)
+      return;
+
+    // The outermost macro is the command name, e.g. FS_IOC_GETFLAGS that expands to _IOR(...).
+    SourceLocation loc = cmd->getBeginLoc();
+    if (!loc.isMacroID())
+      return;
+    while (sm.getImmediateMacroCallerLoc(loc).isMacroID())
+      loc = sm.getImmediateMacroCallerLoc(loc);
+    const std::string name = Lexer::getImmediateMacroName(loc, sm, context->getLangOpts()).str();
+    if (name.empty() || name[0] == '_')
+      return; // the _IO* macro is used directly in the case label
+
+    std::string decl, arg, comment;
+    if (dir) {
+      const auto *size = findSizeof(cmd);
+      if (size) {
+        const QualType type = size->getTypeOfArgument().getCanonicalType();
+        const auto bytes = context->getTypeSizeInChars(type).getQuantity();
+        const auto *record = type->getAsRecordDecl();
+        if (type->isIntegerType() && (bytes == 1 || bytes == 2 || bytes == 4 || bytes == 8)) {
+          arg = std::string("ptr[") + dir + ", int" + std::to_string(bytes * 8) + "]";
+        } else if (EmitTypes && record && record->getIdentifier()) {
+          // The struct is declared once and shared by all ioctls using it,
+          // the driver reports conflicting declarations (e.g. different sizes in different files).
+          const std::string typeName = record->getName().str() + "_auto";
+          decl = "type " + typeName + " array[int8, " + std::to_string(bytes) + "] # TODO: describe " +
+                 type.getAsString();
+          arg = std::string("ptr[") + dir + ", " + typeName + "]";
+        } else {
+          // Structs and other aggregates are not described yet, use an opaque buffer of the right size.
+          arg = std::string("ptr[") + dir + ", array[int8, " + std::to_string(bytes) + "]]";
+          comment = " # TODO: describe " + type.getAsString();
+        }
+      } else {
+        arg = "intptr";
+        comment = " # TODO: argument type is not resolved";
+      }
+    }
+
+    // The location applies to the following description, so declarations are printed before it.
+    if (!decl.empty())
+      puts(decl.c_str());
+    printLocation(sm, cmd->getBeginLoc());
+    printf("ioctl$%s(fd intptr, cmd const[%s]", name.c_str(), name.c_str());
+    if (!arg.empty())
+      printf(", arg %s", arg.c_str());
+    printf(") (automatic)%s\n", comment.c_str());
+  }
+};
+
 int main(int argc, const char **argv) {
-  llvm::cl::OptionCategory SyzDeclExtractOptionCategory("SyzDeclExtract options");
   auto ExpectedParser = clang::tooling::CommonOptionsParser::create(argc, argv, SyzDeclExtractOptionCategory);
 
   if (!ExpectedParser) {
@@ -102,5 +193,11 @@ int main(int argc, const char **argv) {
   Printer Printer;
   MatchFinder Finder;
   Finder.addMatcher(MetaDataMatcher, &Printer);
+
+  IoctlPrinter IoctlPrinters[] = {nullptr, "out", "in", "inout"};
+  const char *IoctlMacros[] = {"_IO", "_IOR", "_IOW", "_IOWR"};
+  for (int i = 0; i < 4; i++)
+    Finder.addMatcher(caseStmt(has(constantExpr(isExpandedFromMacro(IoctlMacros[i])).bind("Cmd"))),
+                      &IoctlPrinters[i]);
   return Tool.run(clang::tooling::newFrontendActionFactory(&Finder).get());
 }
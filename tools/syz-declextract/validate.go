@@ -0,0 +1,86 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/compiler"
+	"github.com/google/syzkaller/sys/targets"
+)
+
+// validateOutput checks that the generated descriptions are accepted by the descriptions compiler.
+// Values of all consts (syscall numbers) are fabricated, so only syntax and types are checked.
+// origins maps full syscall names to the source files they were extracted from,
+// it's used to attribute errors to source files.
+func validateOutput(data []byte, origins map[string]string) error {
+	const filename = "output.txt"
+	var errs []string
+	eh := func(pos ast.Pos, msg string) {
+		errs = append(errs, fmt.Sprintf("%v: %v", pos, msg))
+		lines := strings.Split(string(data), "\n")
+		if pos.File == filename && pos.Line >= 1 && pos.Line <= len(lines) {
+			if file := origins[descriptionName(lines[pos.Line-1])]; file != "" {
+				errs[len(errs)-1] = fmt.Sprintf("%v: %v", file, errs[len(errs)-1])
+			}
+		}
+	}
+	target := targets.Get(targets.Linux, targets.AMD64)
+	desc := ast.Parse(data, filename, eh)
+	if resources := undeclaredResources(desc); len(resources) != 0 {
+		if stubs := ast.Parse(resourceStubs(resources), "stubs.txt", eh); stubs != nil {
+			desc.Nodes = append(desc.Nodes, stubs.Nodes...)
+		} else {
+			desc = nil
+		}
+	}
+	if desc != nil {
+		if info := compiler.ExtractConsts(desc, target, eh); info != nil {
+			consts := make(map[string]uint64)
+			for _, fileInfo := range info {
+				for _, c := range fileInfo.Consts {
+					// Values must differ, otherwise flags with all equal values are rejected.
+					// They are kept small to fit into any integer type.
+					consts[c.Name] = uint64(len(consts)%255 + 1)
+				}
+			}
+			if compiler.Compile(desc, consts, target, eh) != nil {
+				return nil
+			}
+		}
+	}
+	if len(errs) == 0 {
+		errs = append(errs, "unknown error")
+	}
+	return fmt.Errorf("generated descriptions are invalid:\n%v", strings.Join(errs, "\n"))
+}
+
+// undeclaredResources returns resources returned by syscalls that are not declared in desc
+// (they come from sys/linux).
+func undeclaredResources(desc *ast.Description) []string {
+	if desc == nil {
+		return nil
+	}
+	declared := make(map[string]bool)
+	var returned []string
+	for _, node := range desc.Nodes {
+		switch n := node.(type) {
+		case *ast.Resource:
+			declared[n.Name.Name] = true
+		case *ast.Call:
+			if n.Ret != nil {
+				returned = append(returned, n.Ret.Ident)
+			}
+		}
+	}
+	var res []string
+	for _, name := range returned {
+		if !declared[name] {
+			res = append(res, name)
+		}
+	}
+	return res
+}